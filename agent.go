@@ -0,0 +1,485 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// signatureHeader holds the HMAC-SHA256 of the timestamp and request body
+	signatureHeader = "X-GoDash-Signature"
+	// timestampHeader holds the unix time a request was signed at
+	timestampHeader = "X-GoDash-Timestamp"
+	// nonceHeader holds a random value that makes every signed request unique
+	nonceHeader = "X-GoDash-Nonce"
+	// signatureWindow is how old a signed request may be before it is rejected
+	signatureWindow = 5 * time.Minute
+	// agentQueue is how many results an agent buffers while the coordinator is slow
+	agentQueue = 1000
+)
+
+var (
+	// agentClient sends agent requests, the timeout stops a hung coordinator from stalling an agent
+	agentClient = &http.Client{
+		Timeout: 30 * time.Second,
+	}
+)
+
+// AgentInfo describes a registered remote agent
+type AgentInfo struct {
+	Location string `json:"location"`
+	Machine  string `json:"machine"`
+	Seen     int64  `json:"seen"`
+}
+
+// MultiResult merges the latest result of a task from every location
+type MultiResult struct {
+	Task      string            `json:"task"`
+	Label     string            `json:"label"`
+	ID        string            `json:"id"`
+	Date      int64             `json:"date"`
+	Warn      bool              `json:"warn,omitempty"`
+	Locations map[string]Result `json:"locations"`
+}
+
+// Coordinator hands tasks to remote agents by location and merges the results they push back
+type Coordinator struct {
+	Secret   []byte
+	Callback func(MultiResult) // Called every time a location reports a result
+	mu       sync.Mutex
+	tasks    []Task
+	agents   map[string]AgentInfo
+	results  map[string]*MultiResult
+	nonces   map[string]time.Time // Nonces seen within the signature window, by expiry
+}
+
+// NewCoordinator creates a coordinator for the given tasks, agents must sign requests with
+// secret, which must not be empty
+func NewCoordinator(secret string, tasks []Task) (*Coordinator, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("coordinator secret must not be empty")
+	}
+	return &Coordinator{
+		Secret:  []byte(secret),
+		tasks:   tasks,
+		agents:  map[string]AgentInfo{},
+		results: map[string]*MultiResult{},
+		nonces:  map[string]time.Time{},
+	}, nil
+}
+
+// SetTasks replaces the tasks handed out to agents, they pick them up on their next poll
+func (c *Coordinator) SetTasks(tasks []Task) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tasks = tasks
+}
+
+// Agents lists every agent that has registered
+func (c *Coordinator) Agents() []AgentInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	agents := make([]AgentInfo, 0, len(c.agents))
+	for _, a := range c.agents {
+		agents = append(agents, a)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].Location+agents[i].Machine < agents[j].Location+agents[j].Machine
+	})
+	return agents
+}
+
+// View returns the merged results of every task
+func (c *Coordinator) View() []MultiResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	view := make([]MultiResult, 0, len(c.results))
+	for _, m := range c.results {
+		view = append(view, m.copy())
+	}
+	sort.Slice(view, func(i, j int) bool {
+		return view[i].ID < view[j].ID
+	})
+	return view
+}
+
+// ServeHTTP handles agent requests: POST register, tasks and results, GET results.
+// Replies are signed with the nonce of the request so agents can verify them
+func (c *Coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(c.Secret) == 0 {
+		http.Error(w, "coordinator secret is not set", http.StatusInternalServerError)
+		return
+	}
+	body, err := verify(c.Secret, r)
+	if err == nil && !c.fresh(r.Header.Get(nonceHeader)) {
+		err = fmt.Errorf("request nonce has already been used")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	nonce := r.Header.Get(nonceHeader)
+	switch endpoint := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]; {
+	case endpoint == "register" && r.Method == http.MethodPost:
+		var info AgentInfo
+		if err := json.Unmarshal(body, &info); err != nil || len(info.Location) == 0 {
+			http.Error(w, "invalid agent", http.StatusBadRequest)
+			return
+		}
+		info.Seen = time.Now().Unix()
+		c.mu.Lock()
+		c.agents[info.Location+"/"+info.Machine] = info
+		c.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case endpoint == "tasks" && r.Method == http.MethodPost:
+		var info AgentInfo
+		if err := json.Unmarshal(body, &info); err != nil || len(info.Location) == 0 {
+			http.Error(w, "invalid agent", http.StatusBadRequest)
+			return
+		}
+		info.Seen = time.Now().Unix()
+		c.mu.Lock()
+		c.agents[info.Location+"/"+info.Machine] = info
+		tasks := []Task{}
+		for _, t := range c.tasks {
+			if t.Location == info.Location {
+				tasks = append(tasks, t)
+			}
+		}
+		c.mu.Unlock()
+		c.reply(w, r, nonce, tasks)
+	case endpoint == "results" && r.Method == http.MethodPost:
+		var results []sharedResult
+		if err := json.Unmarshal(body, &results); err != nil {
+			http.Error(w, "invalid results", http.StatusBadRequest)
+			return
+		}
+		for _, sr := range results {
+			result := sr.Result
+			result.Error = decodeError(sr.Error, result.ErrorString)
+			c.merge(result)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case endpoint == "results" && r.Method == http.MethodGet:
+		c.reply(w, r, nonce, c.View())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// fresh records a request nonce, returns false if it was already used within the signature window
+func (c *Coordinator) fresh(nonce string) bool {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n, expiry := range c.nonces {
+		if now.After(expiry) {
+			delete(c.nonces, n)
+		}
+	}
+	if _, seen := c.nonces[nonce]; seen {
+		return false
+	}
+	// Timestamps may be up to a window in the future, keep nonces until both sides have passed
+	c.nonces[nonce] = now.Add(2 * signatureWindow)
+	return true
+}
+
+// reply writes v as a JSON response signed with the method, path and nonce of the request
+func (c *Coordinator) reply(w http.ResponseWriter, r *http.Request, nonce string, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(timestampHeader, ts)
+	w.Header().Set(signatureHeader, signature(c.Secret, r.Method, r.URL.Path, ts, nonce, body))
+	w.Write(body)
+}
+
+// merge stores a result under its location and reports the merged view
+func (c *Coordinator) merge(result Result) {
+	if len(result.ID) == 0 || len(result.Location) == 0 {
+		return
+	}
+	c.mu.Lock()
+	m, ok := c.results[result.ID]
+	if !ok {
+		m = &MultiResult{
+			Locations: map[string]Result{},
+		}
+		c.results[result.ID] = m
+	}
+	m.Task, m.Label, m.ID = result.Task, result.Label, result.ID
+	if result.Date > m.Date {
+		m.Date = result.Date
+	}
+	m.Locations[result.Location] = result
+	m.Warn = false
+	for _, r := range m.Locations {
+		m.Warn = m.Warn || r.Warn || r.Error != nil
+	}
+	merged := m.copy()
+	c.mu.Unlock()
+	if c.Callback != nil {
+		c.Callback(merged)
+	}
+}
+
+// copy returns a MultiResult that does not share its locations map
+func (m *MultiResult) copy() MultiResult {
+	out := *m
+	out.Locations = make(map[string]Result, len(m.Locations))
+	for l, r := range m.Locations {
+		out.Locations[l] = r
+	}
+	return out
+}
+
+// Agent runs the tasks a coordinator assigns to its location and pushes the results back
+type Agent struct {
+	URL      string        // Base URL of the coordinator
+	Location string        // Location name tasks are assigned by
+	Machine  string        // Name of this machine, defaults to the hostname
+	Secret   []byte        // Shared secret used to sign requests
+	Poll     time.Duration // How often to pull task definitions, defaults to one minute
+	Options  SchedulerOptions
+}
+
+// NewAgent creates an agent for a location, secret must not be empty
+func NewAgent(coordinator string, location string, secret string) (*Agent, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("agent secret must not be empty")
+	}
+	machine, _ := os.Hostname()
+	return &Agent{
+		URL:      strings.TrimSuffix(coordinator, "/"),
+		Location: location,
+		Machine:  machine,
+		Secret:   []byte(secret),
+		Poll:     time.Minute,
+	}, nil
+}
+
+// Run registers with the coordinator and runs assigned tasks until the context is done
+func (a *Agent) Run(ctx context.Context) error {
+	if _, err := url.ParseRequestURI(a.URL); err != nil {
+		return fmt.Errorf("invalid coordinator URL: %w", err)
+	}
+	if len(a.Secret) == 0 {
+		return fmt.Errorf("agent secret must not be empty")
+	}
+	info := AgentInfo{
+		Location: a.Location,
+		Machine:  a.Machine,
+	}
+	if err := a.post("register", info, nil); err != nil {
+		return err
+	}
+	// Results are queued and sent by push so a slow coordinator does not block the workers
+	queue := make(chan Result, agentQueue)
+	options := a.Options
+	options.Callback = func(result Result) {
+		result.Location = a.Location
+		select {
+		case queue <- result:
+		default:
+			log.Printf("coordinator is too slow, dropping result of task %q", result.ID)
+		}
+	}
+	scheduler := NewScheduler(options)
+	scheduler.Start(ctx)
+	defer scheduler.Stop()
+	pushed := make(chan struct{})
+	go func() {
+		defer close(pushed)
+		a.push(ctx, queue)
+	}()
+	defer func() { <-pushed }()
+	poll := a.Poll
+	if poll <= 0 {
+		poll = time.Minute
+	}
+	for {
+		if err := a.sync(scheduler, info); err != nil {
+			log.Println(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(poll):
+		}
+	}
+}
+
+// sync pulls the tasks assigned to this location and reconciles the scheduler with them,
+// the reply is only used when its signature matches the request
+func (a *Agent) sync(scheduler *Scheduler, info AgentInfo) error {
+	var tasks []Task
+	if err := a.post("tasks", info, &tasks); err != nil {
+		return err
+	}
+	for i := range tasks {
+		tasks[i].Location = a.Location
+	}
+	_, err := scheduler.Reconcile(tasks)
+	return err
+}
+
+// push sends queued results to the coordinator in batches until the context is done
+func (a *Agent) push(ctx context.Context, queue chan Result) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case result := <-queue:
+			results := []Result{result}
+		batch:
+			for len(results) < 100 {
+				select {
+				case result := <-queue:
+					results = append(results, result)
+				default:
+					break batch
+				}
+			}
+			if err := a.post("results", results, nil); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// post sends a signed JSON request to the coordinator and decodes the signed reply into out
+func (a *Agent) post(endpoint string, in interface{}, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	// Not CreateRequest, the coordinator is set by the operator and TargetPolicy is for tasks
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", a.URL, endpoint), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("%s/%s", Project, Version))
+	req.Header.Set("Content-Type", "application/json")
+	nonce, err := sign(a.Secret, req, body)
+	if err != nil {
+		return err
+	}
+	resp, err := agentClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("coordinator %s returned status code: %d", endpoint, resp.StatusCode)
+	}
+	if out != nil {
+		reply, err := ioutil.ReadAll(io.LimitReader(resp.Body, 10<<20))
+		if err != nil {
+			return err
+		}
+		if err := checkSignature(a.Secret, req.Method, req.URL.Path, resp.Header, nonce, reply); err != nil {
+			return fmt.Errorf("coordinator %s reply: %w", endpoint, err)
+		}
+		return json.Unmarshal(reply, out)
+	}
+	return nil
+}
+
+// sign adds a timestamp, a random nonce and HMAC signature of the method, path and body to
+// a request, the nonce is returned to verify the reply
+func sign(secret []byte, req *http.Request, body []byte) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(b)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(timestampHeader, ts)
+	req.Header.Set(nonceHeader, nonce)
+	req.Header.Set(signatureHeader, signature(secret, req.Method, req.URL.Path, ts, nonce, body))
+	return nonce, nil
+}
+
+// verify checks the signature of a request and returns its body
+func verify(secret []byte, r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+	nonce := r.Header.Get(nonceHeader)
+	if len(nonce) == 0 {
+		return nil, fmt.Errorf("missing request nonce")
+	}
+	if err := checkSignature(secret, r.Method, r.URL.Path, r.Header, nonce, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// checkSignature checks the timestamp and HMAC signature headers of a request or of the
+// reply to a request with the given method and path
+func checkSignature(secret []byte, method string, path string, header http.Header, nonce string, body []byte) error {
+	ts := header.Get(timestampHeader)
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing signature timestamp")
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > signatureWindow || age < -signatureWindow {
+		return fmt.Errorf("signature timestamp is outside the allowed window")
+	}
+	expected, err := hex.DecodeString(signature(secret, method, path, ts, nonce, body))
+	if err != nil {
+		return err
+	}
+	given, err := hex.DecodeString(header.Get(signatureHeader))
+	if err != nil || !hmac.Equal(given, expected) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// signature is the hex HMAC-SHA256 of the method, path, timestamp, nonce and body, so a
+// signed body cannot be replayed to another endpoint
+func signature(secret []byte, method string, path string, ts string, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(path))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
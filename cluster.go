@@ -0,0 +1,222 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	// acquireScript takes a lease if it is free or extends it if we already hold it
+	acquireScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0`)
+	// releaseScript drops a lease only if we hold it
+	releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+// Cluster uses Redis leases so each task runs on exactly one instance, and
+// shares results between every instance with pub/sub
+type Cluster struct {
+	Redis    Redis
+	Instance string        // Unique name of this instance
+	TTL      time.Duration // Lease length, renewed in the background while held
+	Horizon  time.Duration // How long leases of Once tasks are kept after they ran
+	Prefix   string        // Prefix for Redis keys and channels
+	mu       sync.Mutex
+	held     map[string]bool
+}
+
+// clusterMessage is a result shared with other instances
+type clusterMessage struct {
+	Instance string `json:"instance"`
+	Result   Result `json:"result"`
+}
+
+// sharedResult decodes results where Error was marshaled without a type
+type sharedResult struct {
+	Result
+	Error json.RawMessage `json:"error"`
+}
+
+// NewCluster creates a cluster member, instance defaults to the hostname and a random suffix
+func NewCluster(r Redis, instance string) *Cluster {
+	if len(instance) == 0 {
+		host, _ := os.Hostname()
+		instance = fmt.Sprintf("%s-%d", host, rand.Int63())
+	}
+	return &Cluster{
+		Redis:    r,
+		Instance: instance,
+		TTL:      15 * time.Second,
+		Horizon:  24 * time.Hour,
+		Prefix:   "godash",
+		held:     map[string]bool{},
+	}
+}
+
+// Enabled reports if the cluster has a Redis client to coordinate with
+func (c *Cluster) Enabled() bool {
+	return c != nil && c.Redis.Enabled && c.Redis.Client != nil
+}
+
+// Acquire takes or extends the lease for a task, returns true if this instance should run it
+func (c *Cluster) Acquire(id string) (bool, error) {
+	if !c.Enabled() {
+		return false, NewError(ClassConfig, "redis is not enabled")
+	}
+	n, err := acquireScript.Run(c.Redis.Context, c.Redis.Client, []string{c.key(id)}, c.Instance, c.TTL.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n == 1 {
+		c.held[id] = true
+	} else {
+		delete(c.held, id)
+	}
+	return n == 1, nil
+}
+
+// Keep holds the lease for a task for at least ttl without renewing it, used for Once
+// tasks so instances whose timer fires later do not run them again
+func (c *Cluster) Keep(id string, ttl time.Duration) error {
+	c.mu.Lock()
+	held := c.held[id]
+	delete(c.held, id)
+	c.mu.Unlock()
+	if !held || !c.Enabled() {
+		return nil
+	}
+	if ttl < c.TTL {
+		ttl = c.TTL
+	}
+	return acquireScript.Run(c.Redis.Context, c.Redis.Client, []string{c.key(id)}, c.Instance, ttl.Milliseconds()).Err()
+}
+
+// Release gives up the lease for a task so another instance can take it
+func (c *Cluster) Release(id string) error {
+	c.mu.Lock()
+	held := c.held[id]
+	delete(c.held, id)
+	c.mu.Unlock()
+	if !held || !c.Enabled() {
+		return nil
+	}
+	return releaseScript.Run(c.Redis.Context, c.Redis.Client, []string{c.key(id)}, c.Instance).Err()
+}
+
+// ReleaseAll gives up every lease held by this instance
+func (c *Cluster) ReleaseAll() {
+	for _, id := range c.leases() {
+		if err := c.Release(id); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Renew extends every held lease until the context is done
+func (c *Cluster) Renew(ctx context.Context) {
+	if !c.Enabled() {
+		return
+	}
+	ticker := time.NewTicker(c.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, id := range c.leases() {
+				if _, err := c.Acquire(id); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}
+}
+
+// Publish shares a result with the other instances
+func (c *Cluster) Publish(result Result) error {
+	if !c.Enabled() {
+		return NewError(ClassConfig, "redis is not enabled")
+	}
+	msg, err := json.Marshal(clusterMessage{
+		Instance: c.Instance,
+		Result:   result,
+	})
+	if err != nil {
+		return err
+	}
+	return c.Redis.Client.Publish(c.Redis.Context, c.channel(), msg).Err()
+}
+
+// Subscribe calls fn with results published by other instances until the context is done
+func (c *Cluster) Subscribe(ctx context.Context, fn func(Result)) {
+	if !c.Enabled() {
+		return
+	}
+	sub := c.Redis.Client.Subscribe(ctx, c.channel())
+	defer sub.Close()
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m, ok := <-messages:
+			if !ok {
+				return
+			}
+			var msg struct {
+				Instance string       `json:"instance"`
+				Result   sharedResult `json:"result"`
+			}
+			if err := json.Unmarshal([]byte(m.Payload), &msg); err != nil {
+				log.Println(err)
+				continue
+			}
+			if msg.Instance == c.Instance {
+				continue
+			}
+			result := msg.Result.Result
+			result.Error = decodeError(msg.Result.Error, result.ErrorString)
+			fn(result)
+		}
+	}
+}
+
+// leases lists the task IDs this instance holds
+func (c *Cluster) leases() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]string, 0, len(c.held))
+	for id := range c.held {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (c *Cluster) key(id string) string {
+	return fmt.Sprintf("%s:lease:%s", c.Prefix, id)
+}
+
+func (c *Cluster) channel() string {
+	return fmt.Sprintf("%s:results", c.Prefix)
+}
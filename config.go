@@ -0,0 +1,620 @@
+package tasks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// configExtensions are the file types loaded from config directories
+	configExtensions = map[string]bool{
+		".yaml": true,
+		".yml":  true,
+		".json": true,
+		".toml": true,
+	}
+	// envVar matches ${NAME} and ${NAME:-default}, secret references such as ${env:NAME}
+	// do not match and are left for ResolveSecrets at run time
+	envVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+	// taskFields are the keys of tasks, groups, templates and defaults
+	taskFields = map[string]bool{
+		"label":    true,
+		"interval": true,
+		"task":     true,
+		"id":       true,
+		"location": true,
+		"once":     true,
+		"template": true,
+		"params":   true,
+	}
+)
+
+// Config is a set of tasks loaded from config files
+type Config struct {
+	Tasks []Task
+	Files []string // Every file that was read, e.g. to watch for changes
+}
+
+// ConfigError is a problem found in a config file
+type ConfigError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+// Error returns the error as file:line: message
+func (e ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.File, e.Message)
+}
+
+// ConfigErrors lists every problem found while loading a config
+type ConfigErrors []ConfigError
+
+// Error returns every error on its own line
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// source is where a config value was set
+type source struct {
+	file string
+	line int
+}
+
+// taskSpec is a task, group, template or defaults block as written in a config file
+type taskSpec struct {
+	fields map[string]interface{}
+	params map[string]interface{}
+	at     map[string]source // Where each field and param ("params.name") was set
+	pos    source
+}
+
+// configEntry is a task along with the blocks it inherits from
+type configEntry struct {
+	defaults *taskSpec
+	group    *taskSpec
+	task     *taskSpec
+}
+
+// configLoader holds the state of a LoadConfig call
+type configLoader struct {
+	loaded    map[string]bool
+	files     []string
+	templates map[string]*taskSpec
+	entries   []configEntry
+	errs      ConfigErrors
+}
+
+// LoadConfig loads tasks from YAML, JSON and TOML files, directories and globs. Files may
+// include other files, set defaults for their own tasks and groups of tasks, and define
+// named templates that tasks in any file extend. Top level keys starting with "x-" are
+// ignored so they can hold YAML anchors. ${NAME} and ${NAME:-default} read environment
+// variables with one of SecretEnvPrefixes as secret references. Every task is validated against TaskParams and all problems are
+// returned together as ConfigErrors
+func LoadConfig(paths ...string) (*Config, error) {
+	l := &configLoader{
+		loaded:    map[string]bool{},
+		templates: map[string]*taskSpec{},
+	}
+	for _, path := range paths {
+		l.loadPath(path, source{})
+	}
+	tasks := l.resolve()
+	if len(l.errs) > 0 {
+		return nil, l.errs
+	}
+	return &Config{
+		Tasks: tasks,
+		Files: l.files,
+	}, nil
+}
+
+// loadPath loads a file, every config file in a directory or every file matching a glob
+func (l *configLoader) loadPath(path string, from source) {
+	matches := []string{path}
+	if strings.ContainsAny(path, "*?[") {
+		var err error
+		if matches, err = filepath.Glob(path); err != nil {
+			l.fail(from, "invalid include %q: %s", path, err)
+			return
+		}
+	}
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			l.fail(from, "%s", err)
+			continue
+		}
+		if !info.IsDir() {
+			l.loadFile(match)
+			continue
+		}
+		entries, err := ioutil.ReadDir(match)
+		if err != nil {
+			l.fail(from, "%s", err)
+			continue
+		}
+		for _, e := range entries { // ReadDir sorts by name
+			if !e.IsDir() && configExtensions[strings.ToLower(filepath.Ext(e.Name()))] {
+				l.loadFile(filepath.Join(match, e.Name()))
+			}
+		}
+	}
+}
+
+// loadFile parses a config file, files that were already loaded are skipped so include
+// cycles end
+func (l *configLoader) loadFile(path string) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if l.loaded[path] {
+		return
+	}
+	l.loaded[path] = true
+	l.files = append(l.files, path)
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		l.fail(source{file: path}, "%s", err)
+		return
+	}
+	var root *yaml.Node
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		tree, err := toml.LoadBytes(contents)
+		if err != nil {
+			l.fail(source{file: path}, "%s", err)
+			return
+		}
+		root = tomlNode(tree, 1)
+	} else {
+		var doc yaml.Node
+		if err := yaml.Unmarshal(contents, &doc); err != nil {
+			l.fail(source{file: path}, "%s", err)
+			return
+		}
+		if len(doc.Content) == 0 {
+			return // Empty file
+		}
+		root = doc.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		l.fail(source{path, root.Line}, "config must be a map")
+		return
+	}
+	l.expandEnv(path, root)
+	var defaults *taskSpec
+	keys := pairs(root)
+	for _, kv := range keys {
+		at := source{path, kv[0].Line}
+		switch kv[0].Value {
+		case "include":
+			for _, inc := range l.strings(path, kv[1]) {
+				if !filepath.IsAbs(inc) {
+					inc = filepath.Join(filepath.Dir(path), inc)
+				}
+				l.loadPath(inc, at)
+			}
+		case "defaults":
+			defaults = l.spec(path, kv[1], nil)
+		case "templates", "groups", "tasks":
+		default:
+			if !strings.HasPrefix(kv[0].Value, "x-") { // Free for YAML anchors
+				l.fail(at, "unknown key %q", kv[0].Value)
+			}
+		}
+	}
+	for _, kv := range keys {
+		switch kv[0].Value {
+		case "templates":
+			for _, t := range pairs(l.kind(path, kv[1], yaml.MappingNode)) {
+				if _, exists := l.templates[t[0].Value]; exists {
+					l.fail(source{path, t[0].Line}, "template %q is already defined", t[0].Value)
+					continue
+				}
+				l.templates[t[0].Value] = l.spec(path, t[1], nil)
+			}
+		case "groups":
+			for _, g := range l.kind(path, kv[1], yaml.SequenceNode).Content {
+				var tasks *yaml.Node
+				group := l.spec(path, g, map[string]func(*yaml.Node){
+					"name":  func(*yaml.Node) {},
+					"tasks": func(n *yaml.Node) { tasks = n },
+				})
+				if tasks == nil {
+					l.fail(source{path, g.Line}, "group has no tasks")
+					continue
+				}
+				for _, t := range l.kind(path, tasks, yaml.SequenceNode).Content {
+					l.entries = append(l.entries, configEntry{defaults, group, l.spec(path, t, nil)})
+				}
+			}
+		case "tasks":
+			for _, t := range l.kind(path, kv[1], yaml.SequenceNode).Content {
+				l.entries = append(l.entries, configEntry{defaults, nil, l.spec(path, t, nil)})
+			}
+		}
+	}
+}
+
+// spec decodes a task block, extra handles additional keys such as those of groups
+func (l *configLoader) spec(file string, n *yaml.Node, extra map[string]func(*yaml.Node)) *taskSpec {
+	n = l.kind(file, n, yaml.MappingNode)
+	s := &taskSpec{
+		fields: map[string]interface{}{},
+		params: map[string]interface{}{},
+		at:     map[string]source{},
+		pos:    source{file, n.Line},
+	}
+	for _, kv := range pairs(n) {
+		key, at := kv[0].Value, source{file, kv[0].Line}
+		if fn, ok := extra[key]; ok {
+			fn(kv[1])
+			continue
+		}
+		if !taskFields[key] {
+			l.fail(at, "unknown key %q", key)
+			continue
+		}
+		value := resolveAlias(kv[1])
+		switch key {
+		case "params":
+			for _, p := range pairs(l.kind(file, value, yaml.MappingNode)) {
+				var v interface{}
+				if err := p[1].Decode(&v); err != nil {
+					l.fail(source{file, p[0].Line}, "%s", err)
+					continue
+				}
+				s.params[p[0].Value] = v
+				s.at["params."+p[0].Value] = source{file, p[0].Line}
+			}
+		case "once":
+			var once bool
+			if err := value.Decode(&once); err != nil {
+				l.fail(at, "once must be true or false")
+				continue
+			}
+			s.fields[key], s.at[key] = once, at
+		default:
+			if value.Kind != yaml.ScalarNode {
+				l.fail(at, "%s must be a string", key)
+				continue
+			}
+			s.fields[key], s.at[key] = value.Value, at
+		}
+	}
+	return s
+}
+
+// resolve applies defaults, groups and templates to every task and validates them
+func (l *configLoader) resolve() []Task {
+	tasks := []Task{}
+	ids := map[string]source{}
+	for _, e := range l.entries {
+		layers := []*taskSpec{}
+		if e.defaults != nil {
+			layers = append(layers, e.defaults)
+		}
+		if e.group != nil {
+			layers = append(layers, e.group)
+		}
+		layers = append(layers, e.task)
+		merged := mergeSpecs(layers...)
+		if name, ok := merged.fields["template"].(string); ok {
+			chain, err := l.template(name, map[string]bool{})
+			if err != nil {
+				l.fail(merged.source("template"), "%s", err)
+				continue
+			}
+			// Templates sit between the group and the task so tasks can override them
+			merged = mergeSpecs(append(append(layers[:len(layers)-1:len(layers)-1], chain...), e.task)...)
+		}
+		task, ok := l.task(merged)
+		if !ok {
+			continue
+		}
+		if len(task.ID) == 0 {
+			task.ID = TaskHash(task, "")
+		}
+		if prev, exists := ids[task.ID]; exists {
+			l.fail(merged.source("id"), "duplicate task ID %q, first used at %s:%d", task.ID, prev.file, prev.line)
+			continue
+		}
+		ids[task.ID] = merged.source("id")
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+// template returns a template and the templates it extends, the base first
+func (l *configLoader) template(name string, seen map[string]bool) ([]*taskSpec, error) {
+	t, ok := l.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown template %q", name)
+	}
+	if seen[name] {
+		return nil, fmt.Errorf("template %q extends itself", name)
+	}
+	seen[name] = true
+	if base, ok := t.fields["template"].(string); ok {
+		chain, err := l.template(base, seen)
+		if err != nil {
+			return nil, err
+		}
+		return append(chain, t), nil
+	}
+	return []*taskSpec{t}, nil
+}
+
+// task builds and validates a task from a merged spec
+func (l *configLoader) task(s *taskSpec) (Task, bool) {
+	str := func(k string) string {
+		v, _ := s.fields[k].(string)
+		return v
+	}
+	once, _ := s.fields["once"].(bool)
+	task := Task{
+		Label:    str("label"),
+		Interval: str("interval"),
+		Task:     str("task"),
+		ID:       str("id"),
+		Location: str("location"),
+		Once:     once,
+	}
+	valid := true
+	if len(task.Label) == 0 {
+		l.fail(s.pos, "task is missing a label")
+		valid = false
+	}
+	runner, ok := TaskRunners[task.Task]
+	if !ok {
+		if len(task.Task) == 0 {
+			l.fail(s.pos, "task %q is missing a task type", task.Label)
+		} else {
+			l.fail(s.source("task"), "unknown task type %q", task.Task)
+		}
+		return task, false
+	}
+	if !task.Once && !runner.Timerless {
+		if _, err := ParseInterval(task.Interval); err != nil {
+			l.fail(s.source("interval"), "task %q has an invalid interval: %s", task.Label, err)
+			valid = false
+		}
+	}
+	params, err := normalizeParams(s.params)
+	if err != nil {
+		l.fail(s.source("params"), "%s", err)
+		return task, false
+	}
+	for _, perr := range ValidateParams(task.Task, params) {
+		l.fail(s.source("params."+perr.Param), "task %q %s", task.Label, perr.Error())
+		valid = false
+	}
+	if len(params) > 0 {
+		task.Params = params
+	}
+	return task, valid
+}
+
+// source returns where a key was set, falling back to the task itself
+func (s *taskSpec) source(key string) source {
+	if at, ok := s.at[key]; ok {
+		return at
+	}
+	return s.pos
+}
+
+// mergeSpecs merges blocks, later blocks override fields and params of earlier ones
+func mergeSpecs(specs ...*taskSpec) *taskSpec {
+	out := &taskSpec{
+		fields: map[string]interface{}{},
+		params: map[string]interface{}{},
+		at:     map[string]source{},
+	}
+	for _, s := range specs {
+		for k, v := range s.fields {
+			out.fields[k] = v
+		}
+		for k, v := range s.params {
+			out.params[k] = v
+		}
+		for k, v := range s.at {
+			out.at[k] = v
+		}
+		out.pos = s.pos
+	}
+	return out
+}
+
+// normalizeParams converts params to the types encoding/json produces, which runners expect
+func normalizeParams(params map[string]interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("invalid params: %s", err)
+	}
+	out := map[string]interface{}{}
+	return out, json.Unmarshal(b, &out)
+}
+
+// expandEnv checks environment variables in every scalar. Only variables with one of
+// SecretEnvPrefixes may be used, they become ${env:NAME} references so ResolveSecrets reads
+// and redacts them at run time. Defaults of unset variables are used as is, plain scalars
+// are resolved again so a default can still be a number
+func (l *configLoader) expandEnv(file string, n *yaml.Node) {
+	if n.Kind == yaml.ScalarNode && envVar.MatchString(n.Value) {
+		n.Value = envVar.ReplaceAllStringFunc(n.Value, func(ref string) string {
+			m := envVar.FindStringSubmatch(ref)
+			if _, err := envSecret(m[1]); err == nil {
+				return fmt.Sprintf("${env:%s}", m[1])
+			} else if te := ClassifyError(err); te.Class == ClassPermission {
+				l.fail(source{file, n.Line}, "%s", err)
+				return ref
+			}
+			if !strings.Contains(ref, ":-") {
+				l.fail(source{file, n.Line}, "environment variable %s is not set", m[1])
+			}
+			return m[2]
+		})
+		if n.Style == 0 {
+			n.Tag = ""
+		}
+	}
+	for _, c := range n.Content {
+		l.expandEnv(file, c)
+	}
+}
+
+// strings decodes a string or list of strings
+func (l *configLoader) strings(file string, n *yaml.Node) []string {
+	n = resolveAlias(n)
+	if n.Kind == yaml.ScalarNode {
+		return []string{n.Value}
+	}
+	var out []string
+	if err := n.Decode(&out); err != nil {
+		l.fail(source{file, n.Line}, "expected a string or a list of strings")
+	}
+	return out
+}
+
+// kind checks the kind of a node, returning an empty node of that kind when it differs
+func (l *configLoader) kind(file string, n *yaml.Node, kind yaml.Kind) *yaml.Node {
+	n = resolveAlias(n)
+	if n.Kind == kind {
+		return n
+	}
+	name := "a map"
+	if kind == yaml.SequenceNode {
+		name = "a list"
+	}
+	l.fail(source{file, n.Line}, "expected %s", name)
+	return &yaml.Node{Kind: kind, Line: n.Line}
+}
+
+// fail records a config error
+func (l *configLoader) fail(at source, format string, a ...interface{}) {
+	l.errs = append(l.errs, ConfigError{
+		File:    at.file,
+		Line:    at.line,
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+// resolveAlias follows YAML aliases to their anchored node
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+// pairs returns the key and value nodes of a map, applying YAML merge keys ("<<") so
+// keys set in the map itself override merged ones
+func pairs(n *yaml.Node) [][2]*yaml.Node {
+	n = resolveAlias(n)
+	out := [][2]*yaml.Node{}
+	index := map[string]int{}
+	set := func(k *yaml.Node, v *yaml.Node, override bool) {
+		if i, ok := index[k.Value]; ok {
+			if override {
+				out[i] = [2]*yaml.Node{k, v}
+			}
+			return
+		}
+		index[k.Value] = len(out)
+		out = append(out, [2]*yaml.Node{k, v})
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if k := n.Content[i]; k.Tag == "!!merge" || (k.Value == "<<" && k.Style == 0) {
+			merges := []*yaml.Node{resolveAlias(n.Content[i+1])}
+			if merges[0].Kind == yaml.SequenceNode {
+				merges = merges[0].Content
+			}
+			for _, m := range merges {
+				for _, kv := range pairs(m) {
+					set(kv[0], kv[1], false)
+				}
+			}
+		}
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if k := n.Content[i]; !(k.Tag == "!!merge" || (k.Value == "<<" && k.Style == 0)) {
+			set(k, n.Content[i+1], true)
+		}
+	}
+	return out
+}
+
+// tomlNode converts a TOML value to a YAML node, keeping line numbers
+func tomlNode(v interface{}, line int) *yaml.Node {
+	switch v := v.(type) {
+	case *toml.Tree:
+		if pos := v.Position(); !pos.Invalid() {
+			line = pos.Line
+		}
+		n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: line}
+		keys := v.Keys()
+		lines := make(map[string]int, len(keys))
+		for _, k := range keys {
+			lines[k] = line
+			if pos := v.GetPositionPath([]string{k}); !pos.Invalid() {
+				lines[k] = pos.Line
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if lines[keys[i]] != lines[keys[j]] {
+				return lines[keys[i]] < lines[keys[j]]
+			}
+			return keys[i] < keys[j]
+		})
+		for _, k := range keys {
+			n.Content = append(n.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k, Line: lines[k]},
+				tomlNode(v.GetPath([]string{k}), lines[k]),
+			)
+		}
+		return n
+	case []*toml.Tree:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: line}
+		for _, t := range v {
+			n.Content = append(n.Content, tomlNode(t, line))
+		}
+		return n
+	case []interface{}:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: line}
+		for _, e := range v {
+			n.Content = append(n.Content, tomlNode(e, line))
+		}
+		return n
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v, Line: line, Style: yaml.DoubleQuotedStyle}
+	case int64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.FormatInt(v, 10), Line: line}
+	case float64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: strconv.FormatFloat(v, 'g', -1, 64), Line: line}
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v), Line: line}
+	case time.Time:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!timestamp", Value: v.Format(time.RFC3339Nano), Line: line}
+	case fmt.Stringer: // Local dates and times
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v.String(), Line: line, Style: yaml.DoubleQuotedStyle}
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Line: line}
+}
@@ -1,7 +1,6 @@
 package tasks
 
 import (
-	"fmt"
 	"log"
 	"strconv"
 
@@ -11,7 +10,7 @@ import (
 
 // Counter implements Atomic counters for HTTP hooks
 func Counter(args *TaskArgs) Result {
-	token := args.Task.Params["token"].(string)
+	token := utils.ParamsParser(args.Task.Params).Get("token").String()
 	if len(token) > 0 {
 		utils.AddAtomicCallback(token, func(ac *utils.AtomicCounter) {
 			result := NewResult(args.Task)
@@ -24,7 +23,7 @@ func Counter(args *TaskArgs) Result {
 		})
 	} else {
 		return Result{
-			Error: fmt.Errorf("missing counter token"),
+			Error: NewError(ClassConfig, "missing counter token"),
 		}
 	}
 	return Result{}
@@ -35,10 +34,10 @@ func RedisCounter(args *TaskArgs) Result {
 	if args.Redis.Enabled {
 		if err := args.Redis.Client.Ping(args.Redis.Context).Err(); err != nil {
 			return Result{
-				Error: fmt.Errorf(err.Error()),
+				Error: ClassifyError(err),
 			}
 		}
-		token := args.Task.Params["token"].(string)
+		token := utils.ParamsParser(args.Task.Params).Get("token").String()
 		if len(token) > 0 {
 			if val, err := args.Redis.Client.Get(args.Redis.Context, token).Result(); err != redis.Nil || err != nil {
 				if i, err := strconv.Atoi(val); err == nil {
@@ -60,12 +59,12 @@ func RedisCounter(args *TaskArgs) Result {
 			})
 		} else {
 			return Result{
-				Error: fmt.Errorf("missing counter token"),
+				Error: NewError(ClassConfig, "missing counter token"),
 			}
 		}
 	} else {
 		return Result{
-			Error: fmt.Errorf("redis is not enabled"),
+			Error: NewError(ClassConfig, "redis is not enabled"),
 		}
 	}
 	return Result{}
@@ -17,21 +17,22 @@ func DNS(args *TaskArgs) Result {
 		"target":   "example.org",
 		"request":  "A",
 	})
-	req, client := CreateRequest("GET", fmt.Sprintf("%s?name=%s&type=%s", params.Get("provider").String(), params.Get("target").String(), params.Get("request").String()), nil)
+	req, client := CreateTaskRequest("GET", fmt.Sprintf("%s?name=%s&type=%s", params.Get("provider").String(), params.Get("target").String(), params.Get("request").String()), nil, args.Task.Params)
 	req.Header.Set("Accept", "application/dns-json")
 	resp, err := client.Do(req)
 	if err != nil {
-		result.Error = err
+		result.Fail(err)
 	} else {
 		defer resp.Body.Close()
 		contents, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			result.Error = err
+			result.Fail(err)
 		} else {
 			status := gjson.Get(string(contents), "Status").String()
 			result.Warn = status != "0"
 			if result.Warn {
 				result.Notification = fmt.Sprintf("invalid %s record has been detected! Status code: %s", params.Get("request").String(), status)
+				result.Warning(NewError(ClassDNS, "%s lookup returned DNS status code %s", params.Get("request").String(), status))
 			}
 			result.Update = struct {
 				Valid bool `json:"valid"`
@@ -40,9 +41,6 @@ func DNS(args *TaskArgs) Result {
 			}
 		}
 	}
-	if result.Error != nil {
-		result.Notification = fmt.Sprintf("a DNS error has occurred: %q", result.Error)
-	}
 	return result
 }
 
@@ -56,16 +54,16 @@ func DNSCIDR(args *TaskArgs) Result {
 	})
 	ranges := params.Get("ranges").Strings()
 	if len(ranges) > 0 {
-		req, client := CreateRequest("GET", fmt.Sprintf("%s?name=%s&type=%s", params.Get("provider").String(), params.Get("target").String(), params.Get("request").String()), nil)
+		req, client := CreateTaskRequest("GET", fmt.Sprintf("%s?name=%s&type=%s", params.Get("provider").String(), params.Get("target").String(), params.Get("request").String()), nil, args.Task.Params)
 		req.Header.Set("Accept", "application/dns-json")
 		resp, err := client.Do(req)
 		if err != nil {
-			result.Error = err
+			result.Fail(err)
 		} else {
 			defer resp.Body.Close()
 			contents, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
-				result.Error = err
+				result.Fail(err)
 			} else {
 				valid := false
 			search:
@@ -90,11 +88,10 @@ func DNSCIDR(args *TaskArgs) Result {
 			}
 		}
 	} else {
-		result.Cancelled = args.Task.Cancel()
-		result.Error = fmt.Errorf("missing ranges")
-	}
-	if result.Error != nil {
-		result.Notification = fmt.Sprintf("a DNS-CIDR error has occurred: %q", result.Error)
+		if args.Task.Cancel != nil {
+			result.Cancelled = args.Task.Cancel()
+		}
+		result.Fail(NewError(ClassConfig, "missing ranges"))
 	}
 	return result
 }
@@ -0,0 +1,189 @@
+package tasks
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// ErrorClass groups task failures so the UI and notifiers can filter them
+type ErrorClass string
+
+const (
+	// ClassTimeout is a connection or request that took too long
+	ClassTimeout ErrorClass = "timeout"
+	// ClassDNS is a host name that could not be resolved
+	ClassDNS ErrorClass = "dns_resolution"
+	// ClassRefused is a connection refused by the target
+	ClassRefused ErrorClass = "connection_refused"
+	// ClassNetwork is any other network failure, e.g. an unreachable host
+	ClassNetwork ErrorClass = "network"
+	// ClassTLS is a failed TLS handshake or an invalid certificate
+	ClassTLS ErrorClass = "tls"
+	// ClassHTTPStatus is an unexpected HTTP status code
+	ClassHTTPStatus ErrorClass = "http_status"
+	// ClassProtocol is an error reply from a server, e.g. an SMTP 421 greeting
+	ClassProtocol ErrorClass = "protocol"
+	// ClassParse is a response that could not be parsed or had no value
+	ClassParse ErrorClass = "parse"
+	// ClassConfig is a task with missing or invalid params
+	ClassConfig ErrorClass = "config"
+	// ClassPermission is an action the process is not allowed to do, e.g. raw sockets
+	ClassPermission ErrorClass = "permission"
+	// ClassPolicy is a target blocked by TargetPolicy, it may pass once DNS or the policy changes
+	ClassPolicy ErrorClass = "policy"
+	// ClassPanic is a task runner that panicked
+	ClassPanic ErrorClass = "panic"
+	// ClassUnknown is an error that could not be classified
+	ClassUnknown ErrorClass = "unknown"
+)
+
+var (
+	// retryable lists the classes that may succeed on a later run
+	retryable = map[ErrorClass]bool{
+		ClassTimeout:    true,
+		ClassDNS:        true,
+		ClassRefused:    true,
+		ClassNetwork:    true,
+		ClassHTTPStatus: true,
+		ClassProtocol:   true,
+		ClassPolicy:     true,
+		ClassUnknown:    true,
+	}
+)
+
+// TaskError is a classified task failure, it marshals to JSON unlike plain errors
+type TaskError struct {
+	Class     ErrorClass `json:"class"`
+	Message   string     `json:"message"`
+	Retryable bool       `json:"retryable"`
+	Err       error      `json:"-"`
+}
+
+// Error returns the error message
+func (e *TaskError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the underlying error
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// NewError creates a classified error
+func NewError(class ErrorClass, format string, a ...interface{}) *TaskError {
+	return &TaskError{
+		Class:     class,
+		Message:   fmt.Sprintf(format, a...),
+		Retryable: retryable[class],
+	}
+}
+
+// StatusError creates an http_status error, only server errors and rate limits are retryable
+func StatusError(code int) *TaskError {
+	err := NewError(ClassHTTPStatus, "an invalid status code has been found: %d", code)
+	err.Retryable = code >= 500 || code == 429
+	return err
+}
+
+// ClassifyError wraps an error with its class, classified errors are returned as is
+func ClassifyError(err error) *TaskError {
+	if err == nil {
+		return nil
+	}
+	var te *TaskError
+	if errors.As(err, &te) {
+		return te
+	}
+	class := ClassUnknown
+	var (
+		dnsErr    *net.DNSError
+		netErr    net.Error
+		opErr     *net.OpError
+		authErr   x509.UnknownAuthorityError
+		certErr   x509.CertificateInvalidError
+		hostErr   x509.HostnameError
+		recordErr tls.RecordHeaderError
+		httpErr   gofeed.HTTPError
+		jsonErr   *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+		xmlErr    *xml.SyntaxError
+		numErr    *strconv.NumError
+		syntaxErr *syntax.Error
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		class = ClassDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		class = ClassTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		class = ClassRefused
+	case errors.Is(err, os.ErrPermission):
+		class = ClassPermission
+	case errors.As(err, &authErr), errors.As(err, &certErr), errors.As(err, &hostErr), errors.As(err, &recordErr), strings.Contains(err.Error(), "tls: "), strings.Contains(err.Error(), "x509: "):
+		class = ClassTLS
+	case errors.As(err, &httpErr):
+		return StatusError(httpErr.StatusCode)
+	case errors.As(err, &syntaxErr):
+		class = ClassConfig
+	case errors.As(err, &jsonErr), errors.As(err, &typeErr), errors.As(err, &xmlErr), errors.As(err, &numErr), errors.Is(err, gofeed.ErrFeedTypeNotDetected):
+		class = ClassParse
+	case errors.As(err, &opErr), errors.As(err, &netErr):
+		class = ClassNetwork
+	}
+	te = &TaskError{
+		Class:     class,
+		Message:   err.Error(),
+		Retryable: retryable[class],
+		Err:       err,
+	}
+	if dnsErr != nil && dnsErr.IsNotFound {
+		te.Retryable = false // The name does not exist, not a lookup failure
+	}
+	return te
+}
+
+// Fail classifies an error and sets it on the result along with a matching notification
+func (r *Result) Fail(err error) {
+	te := ClassifyError(err)
+	if te == nil {
+		return
+	}
+	r.Error = te
+	r.ErrorString = te.Message
+	r.Notification = fmt.Sprintf("a %s error has occurred: %q", strings.ReplaceAll(string(te.Class), "_", " "), te.Message)
+}
+
+// Warning classifies an error and sets it on a warning result, the notification is kept so
+// warn-only states such as an unexpected status code read as before and are not cancelled
+func (r *Result) Warning(err error) {
+	r.Warn = true
+	if te := ClassifyError(err); te != nil {
+		r.Error = te
+		r.ErrorString = te.Message
+	}
+}
+
+// decodeError rebuilds a result error that was marshaled to JSON
+func decodeError(raw json.RawMessage, message string) error {
+	var te TaskError
+	if err := json.Unmarshal(raw, &te); err == nil && len(te.Class) > 0 {
+		return &te
+	}
+	if len(message) > 0 {
+		return errors.New(message)
+	}
+	return nil
+}
@@ -27,9 +27,11 @@ func Feed(args *TaskArgs) Result {
 	defer cancel()
 	fp := gofeed.NewParser()
 	fp.UserAgent = fmt.Sprintf("%s/%s", Project, Version)
+	insecure, _ := paramBool(args.Task.Params, "insecure")
+	fp.Client = newClient(insecure)
 	feed, err := fp.ParseURLWithContext(params.Get("url").String(), ctx)
 	if err != nil {
-		result.Error = err
+		result.Fail(err)
 	} else {
 		items := []item{}
 		for _, i := range feed.Items {
@@ -66,7 +68,7 @@ func FakeFeed(args *TaskArgs) Result {
 	fp := gofeed.NewParser()
 	feed, err := fp.ParseString(genFakeFeed(limit))
 	if err != nil {
-		result.Error = err
+		result.Fail(err)
 	} else {
 		items := []item{}
 		for _, i := range feed.Items {
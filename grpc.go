@@ -0,0 +1,406 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"pkg.goda.sh/utils"
+)
+
+var (
+	// grpcHealthStatus names the grpc.health.v1.HealthCheckResponse statuses
+	grpcHealthStatus = map[uint64]string{
+		0: "UNKNOWN",
+		1: "SERVING",
+		2: "NOT_SERVING",
+		3: "SERVICE_UNKNOWN",
+	}
+	// grpcCodes names the gRPC status codes
+	grpcCodes = []string{"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND", "ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED", "INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED"}
+	// grpcMu guards grpcClients
+	grpcMu sync.Mutex
+	// grpcClients holds the health client of each scheduled task by task ID, so every run
+	// reuses the same HTTP/2 connection
+	grpcClients = map[string]*grpcClient{}
+)
+
+// grpcClient is a cached health client and the fingerprint of the task it was built for
+type grpcClient struct {
+	fingerprint string
+	health      *grpcHealth
+}
+
+// grpcHealth calls the grpc.health.v1.Health service. The health protocol only needs a
+// string and an enum, so it is spoken over plain HTTP/2 rather than pulling in gRPC
+type grpcHealth struct {
+	client    *http.Client
+	transport *http2.Transport
+	url       string
+	service   string
+	metadata  map[string]string
+	timeout   time.Duration
+}
+
+// GRPCHealth calls grpc.health.v1.Health/Check for a "service", the empty service is the
+// health of the whole server. It warns unless the status is SERVING
+func GRPCHealth(args *TaskArgs) Result {
+	result := NewResult(args.Task)
+	h, release, err := taskGRPCHealth(args.Task)
+	if err != nil {
+		result.Fail(err)
+		result.Warn = true
+		return result
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	start := time.Now()
+	status := ""
+	err = h.call(ctx, "Check", h.timeout, func(s string) {
+		status = s
+	})
+	elapsed := time.Since(start)
+	if err == nil && len(status) == 0 {
+		err = NewError(ClassParse, "no health status returned")
+	}
+	if err != nil {
+		result.Fail(err)
+		result.Warn = true
+		result.Spark = &Spark{
+			millis64(elapsed),
+			true,
+		}
+		return result
+	}
+	return h.result(result, status, elapsed)
+}
+
+// GRPCHealthWatch streams grpc.health.v1.Health/Watch for a "service" and reports every
+// status change, the stream is opened again with a backoff when it ends. The "timeout"
+// only limits connecting as the stream stays open
+func GRPCHealthWatch(args *TaskArgs) Result {
+	h, err := newGRPCHealth(args.Task.Params)
+	if err != nil {
+		return Result{
+			Error: err,
+		}
+	}
+	ctx := args.Task.CTX
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	go func() {
+		defer h.close()
+		backoff := time.Second
+		for {
+			start := time.Now()
+			err := h.call(ctx, "Watch", 0, func(status string) {
+				backoff = time.Second
+				args.Callback(h.result(NewResult(args.Task), status, time.Since(start)))
+				start = time.Now()
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			result := NewResult(args.Task)
+			if err == nil {
+				err = NewError(ClassNetwork, "watch stream closed by the server")
+			}
+			result.Fail(err)
+			result.Warn = true
+			args.Callback(result)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+		}
+	}()
+	return Result{}
+}
+
+// taskGRPCHealth returns the health client of a task. Scheduled tasks keep their client
+// until the task changes or its context is done, other calls get a new client that is
+// closed by release
+func taskGRPCHealth(task Task) (h *grpcHealth, release func(), err error) {
+	if task.CTX == nil || len(task.ID) == 0 {
+		if h, err = newGRPCHealth(task.Params); err != nil {
+			return nil, nil, err
+		}
+		return h, h.close, nil
+	}
+	fingerprint := Fingerprint(task)
+	grpcMu.Lock()
+	defer grpcMu.Unlock()
+	if c, ok := grpcClients[task.ID]; ok {
+		if c.fingerprint == fingerprint {
+			return c.health, func() {}, nil
+		}
+		c.health.close()
+		delete(grpcClients, task.ID)
+	}
+	if h, err = newGRPCHealth(task.Params); err != nil {
+		return nil, nil, err
+	}
+	c := &grpcClient{fingerprint, h}
+	grpcClients[task.ID] = c
+	go func() {
+		<-task.CTX.Done()
+		grpcMu.Lock()
+		if grpcClients[task.ID] == c {
+			delete(grpcClients, task.ID)
+		}
+		grpcMu.Unlock()
+		h.close()
+	}()
+	return h, func() {}, nil
+}
+
+// close closes the idle connections of a health client
+func (h *grpcHealth) close() {
+	h.transport.CloseIdleConnections()
+}
+
+// newGRPCHealth creates a health client from task params: "target" is host:port, "tls"
+// enables TLS, "ca", "cert" and "key" are PEM blocks for private CAs and mTLS and
+// "metadata" is sent as headers with each call
+func newGRPCHealth(params map[string]interface{}) (*grpcHealth, error) {
+	p := utils.ParamsParser(params, utils.DefaultParams{
+		"timeout": "10s",
+	})
+	timeout, err := time.ParseDuration(p.Get("timeout").String())
+	if err != nil || timeout <= 0 {
+		return nil, NewError(ClassConfig, "invalid timeout %q", p.Get("timeout").String())
+	}
+	target := p.Get("target").String()
+	if len(target) == 0 {
+		return nil, NewError(ClassConfig, "missing target")
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, NewError(ClassConfig, "target %q must be host:port", target)
+	}
+	useTLS, _ := paramBool(params, "tls")
+	insecure, _ := paramBool(params, "insecure")
+	config := &tls.Config{
+		ServerName:         p.Get("server_name").String(),
+		InsecureSkipVerify: insecure,
+	}
+	if ca := p.Get("ca").String(); len(ca) > 0 {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM([]byte(ca)) {
+			return nil, NewError(ClassConfig, "invalid ca, expected PEM certificates")
+		}
+		useTLS = true
+	}
+	if cert := p.Get("cert").String(); len(cert) > 0 {
+		pair, err := tls.X509KeyPair([]byte(cert), []byte(p.Get("key").String()))
+		if err != nil {
+			return nil, NewError(ClassConfig, "invalid client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+		useTLS = true
+	}
+	useTLS = useTLS || insecure || len(config.ServerName) > 0
+	transport := &http2.Transport{
+		AllowHTTP: !useTLS,
+		DialTLSContext: func(ctx context.Context, network string, addr string, cfg *tls.Config) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			conn, err := TargetPolicy.DialContext(ctx, network, addr)
+			if err != nil || !useTLS {
+				return conn, err
+			}
+			c := tls.Client(conn, cfg)
+			if err := c.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return c, nil
+		},
+		TLSClientConfig: config,
+	}
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	metadata := map[string]string{}
+	if m, ok := params["metadata"].(map[string]interface{}); ok {
+		for k, v := range m {
+			metadata[strings.ToLower(k)] = fmt.Sprint(v)
+		}
+	}
+	return &grpcHealth{
+		client:    &http.Client{Transport: transport},
+		transport: transport,
+		url:       fmt.Sprintf("%s://%s/grpc.health.v1.Health/", scheme, target),
+		service:   p.Get("service").String(),
+		metadata:  metadata,
+		timeout:   timeout,
+	}, nil
+}
+
+// call invokes a health method and passes the status of every response message to fn
+func (h *grpcHealth) call(ctx context.Context, method string, timeout time.Duration, fn func(string)) error {
+	// HealthCheckRequest has the service name as field 1, framed with a compression flag
+	// and the message length
+	msg := make([]byte, 1+binary.MaxVarintLen64)
+	msg[0] = 0x0a
+	msg = append(msg[:1+binary.PutUvarint(msg[1:], uint64(len(h.service)))], h.service...)
+	body := append([]byte{0, 0, 0, 0, 0}, msg...)
+	binary.BigEndian.PutUint32(body[1:5], uint32(len(msg)))
+	req, err := http.NewRequestWithContext(ctx, "POST", h.url+method, bytes.NewReader(body))
+	if err != nil {
+		return NewError(ClassConfig, "%s", err)
+	}
+	for k, v := range h.metadata {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("User-Agent", fmt.Sprintf("%s/%s", Project, Version))
+	if timeout > 0 {
+		req.Header.Set("Grpc-Timeout", fmt.Sprintf("%dm", timeout.Milliseconds()))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return StatusError(resp.StatusCode)
+	}
+	if err := grpcStatus(resp.Header); err != nil { // Trailers only response
+		return err
+	}
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(resp.Body, header); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint32(header[1:])
+		if header[0] != 0 || size > 1<<20 {
+			return NewError(ClassParse, "unsupported gRPC message, compressed or over 1MB")
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(resp.Body, msg); err != nil {
+			return err
+		}
+		status, err := grpcHealthResponse(msg)
+		if err != nil {
+			return err
+		}
+		fn(status)
+	}
+	return grpcStatus(resp.Trailer)
+}
+
+// result fills in a result for a health status
+func (h *grpcHealth) result(result Result, status string, elapsed time.Duration) Result {
+	result.Warn = status != "SERVING"
+	if result.Warn {
+		service := h.service
+		if len(service) == 0 {
+			service = "server"
+		}
+		result.Notification = fmt.Sprintf("gRPC health of %s is %s!", service, status)
+	}
+	result.Spark = &Spark{
+		millis64(elapsed),
+		result.Warn,
+	}
+	result.Update = struct {
+		Service string  `json:"service"`
+		Status  string  `json:"status"`
+		Time    float64 `json:"time"`
+	}{
+		Service: h.service,
+		Status:  status,
+		Time:    millis64(elapsed),
+	}
+	return result
+}
+
+// grpcHealthResponse decodes the status enum, field 1, of a HealthCheckResponse
+func grpcHealthResponse(msg []byte) (string, error) {
+	status := uint64(0)
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return "", NewError(ClassParse, "invalid health check response")
+		}
+		msg = msg[n:]
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return "", NewError(ClassParse, "invalid health check response")
+			}
+			if key>>3 == 1 {
+				status = v
+			}
+			msg = msg[n:]
+		case 1, 2, 5:
+			size := map[uint64]uint64{1: 8, 5: 4}[key&7]
+			if key&7 == 2 {
+				l, n := binary.Uvarint(msg)
+				if n <= 0 {
+					return "", NewError(ClassParse, "invalid health check response")
+				}
+				msg, size = msg[n:], l
+			}
+			if uint64(len(msg)) < size {
+				return "", NewError(ClassParse, "invalid health check response")
+			}
+			msg = msg[size:]
+		default:
+			return "", NewError(ClassParse, "invalid health check response")
+		}
+	}
+	if name, ok := grpcHealthStatus[status]; ok {
+		return name, nil
+	}
+	return strconv.FormatUint(status, 10), nil
+}
+
+// grpcStatus returns the error of a non OK grpc-status
+func grpcStatus(h http.Header) error {
+	s := h.Get("Grpc-Status")
+	if len(s) == 0 || s == "0" {
+		return nil
+	}
+	code, _ := strconv.Atoi(s)
+	name := s
+	if code >= 0 && code < len(grpcCodes) {
+		name = grpcCodes[code]
+	}
+	msg, err := url.PathUnescape(h.Get("Grpc-Message"))
+	if err != nil {
+		msg = h.Get("Grpc-Message")
+	}
+	class := ClassProtocol
+	switch name {
+	case "DEADLINE_EXCEEDED":
+		class = ClassTimeout
+	case "PERMISSION_DENIED", "UNAUTHENTICATED":
+		class = ClassPermission
+	}
+	return NewError(class, "gRPC status %s: %s", name, msg)
+}
@@ -0,0 +1,357 @@
+package tasks
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Point is a single stored result of a task, used for sparklines and tooltips
+type Point struct {
+	Date         int64       `json:"date"`
+	Value        interface{} `json:"value,omitempty"`
+	Warn         bool        `json:"warn,omitempty"`
+	Error        string      `json:"error,omitempty"`
+	Notification string      `json:"notification,omitempty"`
+}
+
+// History stores the results of tasks, points are returned oldest first
+type History interface {
+	Add(id string, point Point) error
+	Last(id string, n int) ([]Point, error)
+	Range(id string, from time.Time, to time.Time) ([]Point, error)
+}
+
+// NewPoint creates a history point from a result
+func NewPoint(result Result) Point {
+	point := Point{
+		Date:         result.Date,
+		Warn:         result.Warn,
+		Error:        result.ErrorString,
+		Notification: result.Notification,
+	}
+	if result.Spark != nil {
+		point.Value = result.Spark.Value
+	}
+	if len(point.Error) == 0 && result.Error != nil {
+		point.Error = result.Error.Error()
+	}
+	return point
+}
+
+// millis converts a time to the millisecond dates used by results
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// MemoryHistory keeps the latest points of each task in a ring buffer
+type MemoryHistory struct {
+	Size  int // Points kept per task
+	mu    sync.RWMutex
+	rings map[string]*ring
+}
+
+// ring is a fixed size buffer of points
+type ring struct {
+	points []Point
+	next   int
+	full   bool
+}
+
+// NewMemoryHistory creates an in-memory history keeping size points per task
+func NewMemoryHistory(size int) *MemoryHistory {
+	if size <= 0 {
+		size = 100
+	}
+	return &MemoryHistory{
+		Size:  size,
+		rings: map[string]*ring{},
+	}
+}
+
+// Add stores a point, dropping the oldest point when the buffer is full
+func (h *MemoryHistory) Add(id string, point Point) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.rings[id]
+	if !ok {
+		r = &ring{points: make([]Point, h.Size)}
+		h.rings[id] = r
+	}
+	r.points[r.next] = point
+	r.next = (r.next + 1) % len(r.points)
+	r.full = r.full || r.next == 0
+	return nil
+}
+
+// Last returns up to n of the newest points
+func (h *MemoryHistory) Last(id string, n int) ([]Point, error) {
+	points := h.all(id)
+	if n >= 0 && len(points) > n {
+		points = points[len(points)-n:]
+	}
+	return points, nil
+}
+
+// Range returns the points dated between from and to
+func (h *MemoryHistory) Range(id string, from time.Time, to time.Time) ([]Point, error) {
+	return between(h.all(id), from, to), nil
+}
+
+// IDs lists the tasks with stored points
+func (h *MemoryHistory) IDs() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ids := make([]string, 0, len(h.rings))
+	for id := range h.rings {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// all returns a copy of every stored point of a task, oldest first
+func (h *MemoryHistory) all(id string) []Point {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	r, ok := h.rings[id]
+	if !ok {
+		return []Point{}
+	}
+	if !r.full {
+		return append([]Point{}, r.points[:r.next]...)
+	}
+	return append(append([]Point{}, r.points[r.next:]...), r.points[:r.next]...)
+}
+
+// between filters points dated between from and to
+func between(points []Point, from time.Time, to time.Time) []Point {
+	start, end := millis(from), millis(to)
+	out := []Point{}
+	for _, p := range points {
+		if p.Date >= start && p.Date <= end {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// FileHistory appends points to a local file as JSON lines, the file is compacted
+// once it holds twice as many lines as points are kept
+type FileHistory struct {
+	path   string
+	mu     sync.Mutex
+	file   *os.File
+	lines  int
+	memory *MemoryHistory
+}
+
+// fileLine is a single line in a history file
+type fileLine struct {
+	ID string `json:"id"`
+	Point
+}
+
+// OpenFileHistory opens or creates a history file keeping size points per task
+func OpenFileHistory(path string, size int) (*FileHistory, error) {
+	h := &FileHistory{
+		path:   path,
+		memory: NewMemoryHistory(size),
+	}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var line fileLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err == nil {
+				h.memory.Add(line.ID, line.Point)
+				h.lines++
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	h.file = f
+	return h, nil
+}
+
+// Add appends a point to the file, compacting it when needed
+func (h *FileHistory) Add(id string, point Point) error {
+	line, err := json.Marshal(fileLine{id, point})
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.memory.Add(id, point)
+	if _, err := h.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	h.lines++
+	if h.lines > 2*h.memory.Size*len(h.memory.IDs()) {
+		return h.compact()
+	}
+	return nil
+}
+
+// Last returns up to n of the newest points
+func (h *FileHistory) Last(id string, n int) ([]Point, error) {
+	return h.memory.Last(id, n)
+}
+
+// Range returns the points dated between from and to
+func (h *FileHistory) Range(id string, from time.Time, to time.Time) ([]Point, error) {
+	return h.memory.Range(id, from, to)
+}
+
+// Compact rewrites the file with only the points that are kept
+func (h *FileHistory) Compact() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.compact()
+}
+
+// Close closes the history file
+func (h *FileHistory) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.file.Close()
+}
+
+// compact writes the kept points to a temporary file and swaps it in, h.mu must be held
+func (h *FileHistory) compact() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(h.path), filepath.Base(h.path)+".*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	lines := 0
+	for _, id := range h.memory.IDs() {
+		for _, p := range h.memory.all(id) {
+			line, err := json.Marshal(fileLine{id, p})
+			if err != nil {
+				continue
+			}
+			w.Write(append(line, '\n'))
+			lines++
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), h.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	h.file.Close()
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	h.file, h.lines = f, lines
+	return nil
+}
+
+// RedisHistory keeps points in a sorted set per task, scored by date
+type RedisHistory struct {
+	Redis  Redis
+	Size   int64  // Points kept per task
+	Prefix string // Prefix for Redis keys
+}
+
+// NewRedisHistory creates a Redis backed history keeping size points per task
+func NewRedisHistory(r Redis, size int64) *RedisHistory {
+	if size <= 0 {
+		size = 100
+	}
+	return &RedisHistory{
+		Redis:  r,
+		Size:   size,
+		Prefix: "godash",
+	}
+}
+
+// Add stores a point and trims the oldest points past the size
+func (h *RedisHistory) Add(id string, point Point) error {
+	member, err := json.Marshal(point)
+	if err != nil {
+		return err
+	}
+	key := h.key(id)
+	_, err = h.Redis.Client.TxPipelined(h.Redis.Context, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(h.Redis.Context, key, &redis.Z{
+			Score:  float64(point.Date),
+			Member: member,
+		})
+		pipe.ZRemRangeByRank(h.Redis.Context, key, 0, -(h.Size + 1))
+		return nil
+	})
+	return err
+}
+
+// Last returns up to n of the newest points
+func (h *RedisHistory) Last(id string, n int) ([]Point, error) {
+	if n == 0 {
+		return []Point{}, nil
+	}
+	start := -int64(n)
+	if n < 0 {
+		start = 0
+	}
+	members, err := h.Redis.Client.ZRange(h.Redis.Context, h.key(id), start, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodePoints(members)
+}
+
+// Range returns the points dated between from and to
+func (h *RedisHistory) Range(id string, from time.Time, to time.Time) ([]Point, error) {
+	members, err := h.Redis.Client.ZRangeByScore(h.Redis.Context, h.key(id), &redis.ZRangeBy{
+		Min: fmt.Sprintf("%d", millis(from)),
+		Max: fmt.Sprintf("%d", millis(to)),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodePoints(members)
+}
+
+func (h *RedisHistory) key(id string) string {
+	return fmt.Sprintf("%s:history:%s", h.Prefix, id)
+}
+
+// decodePoints parses JSON encoded points
+func decodePoints(members []string) ([]Point, error) {
+	points := make([]Point, 0, len(members))
+	for _, m := range members {
+		var p Point
+		if err := json.Unmarshal([]byte(m), &p); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
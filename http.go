@@ -12,20 +12,25 @@ import (
 // HTTP pulls content from a web server
 func HTTP(args *TaskArgs) Result {
 	result := NewResult(args.Task)
-	req, client := CreateRequest("GET", utils.ParamsParser(args.Task.Params).Get("url").String(), nil)
+	req, client := CreateTaskRequest("GET", utils.ParamsParser(args.Task.Params).Get("url").String(), nil, args.Task.Params)
 	resp, err := client.Do(req)
 	if err != nil {
-		result.Error = err
+		result.Fail(err)
 	} else {
 		defer resp.Body.Close()
 		contents, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			result.Error = err
+			result.Fail(err)
 		} else {
 			c := string(contents)
 			result.Warn = len(c) == 0 || !(resp.StatusCode >= 200 && resp.StatusCode <= 299)
 			if result.Warn {
 				result.Notification = fmt.Sprintf("an invalid status code has been found: %d", resp.StatusCode)
+				if len(c) == 0 && resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+					result.Warning(NewError(ClassParse, "no content returned"))
+				} else {
+					result.Warning(StatusError(resp.StatusCode))
+				}
 			}
 			result.Update = struct {
 				Content string `json:"content"`
@@ -41,17 +46,21 @@ func HTTP(args *TaskArgs) Result {
 func HTTPStatus(args *TaskArgs) Result {
 	result := NewResult(args.Task)
 	params := utils.ParamsParser(args.Task.Params)
-	req, client := CreateRequest("HEAD", params.Get("url").String(), nil)
+	codes := params.Get("codes").Ints()
+	if len(codes) == 0 || len(codes) > 2 {
+		result.Fail(NewError(ClassConfig, "codes must be a status code or a range of two status codes"))
+		return result
+	}
+	req, client := CreateTaskRequest("HEAD", params.Get("url").String(), nil, args.Task.Params)
 	resp, err := client.Do(req)
 	if err != nil {
-		result.Error = err
+		result.Fail(err)
 	} else {
 		defer resp.Body.Close()
 		if err != nil {
-			result.Error = err
+			result.Fail(err)
 		} else {
 			valid := false
-			codes := params.Get("codes").Ints()
 			if len(codes) == 1 {
 				valid = resp.StatusCode == int(codes[0])
 			} else {
@@ -60,6 +69,7 @@ func HTTPStatus(args *TaskArgs) Result {
 			result.Warn = !valid
 			if result.Warn {
 				result.Notification = fmt.Sprintf("an invalid status code has been found: %d", resp.StatusCode)
+				result.Warning(StatusError(resp.StatusCode))
 			}
 			result.Update = struct {
 				Content string `json:"content"`
@@ -75,15 +85,15 @@ func HTTPStatus(args *TaskArgs) Result {
 func HTTPJSON(args *TaskArgs) Result {
 	result := NewResult(args.Task)
 	params := utils.ParamsParser(args.Task.Params)
-	req, client := CreateRequest("GET", params.Get("url").String(), nil)
+	req, client := CreateTaskRequest("GET", params.Get("url").String(), nil, args.Task.Params)
 	resp, err := client.Do(req)
 	if err != nil {
-		result.Error = err
+		result.Fail(err)
 	} else {
 		defer resp.Body.Close()
 		contents, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			result.Error = err
+			result.Fail(err)
 		} else {
 			value := gjson.Get(string(contents), params.Get("query").String()).String()
 			l := len(value) == 0
@@ -91,8 +101,10 @@ func HTTPJSON(args *TaskArgs) Result {
 			if result.Warn {
 				if l {
 					result.Notification = "no value returned in JSON query!"
+					result.Warning(NewError(ClassParse, "no value returned in JSON query"))
 				} else {
 					result.Notification = fmt.Sprintf("an invalid status code has been found: %d", resp.StatusCode)
+					result.Warning(StatusError(resp.StatusCode))
 				}
 			}
 			result.Update = struct {
@@ -110,24 +122,24 @@ func HTTPJSON(args *TaskArgs) Result {
 func HTTPREGEXP(args *TaskArgs) Result {
 	result := NewResult(args.Task)
 	params := utils.ParamsParser(args.Task.Params)
-	req, client := CreateRequest("GET", params.Get("url").String(), nil)
+	req, client := CreateTaskRequest("GET", params.Get("url").String(), nil, args.Task.Params)
 	resp, err := client.Do(req)
 	if err != nil {
-		result.Error = err
+		result.Fail(err)
 	} else {
 		defer resp.Body.Close()
 		contents, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			result.Error = err
+			result.Fail(err)
 		} else {
 			if regex := params.Get("regex").String(); len(regex) > 0 {
 				content := string(contents)
 				matcher, err := regexp.Compile(regex)
 				if err != nil {
-					result.Error = err
+					result.Fail(NewError(ClassConfig, "invalid regex: %s", err))
 				} else {
 					if !matcher.MatchString(content) {
-						result.Error = fmt.Errorf("no match")
+						result.Fail(NewError(ClassParse, "no match"))
 					} else {
 						value := matcher.FindStringSubmatch(content)
 						if len(value) == 1 {
@@ -138,8 +150,10 @@ func HTTPREGEXP(args *TaskArgs) Result {
 						if result.Warn {
 							if l {
 								result.Notification = "no value returned in HTML query!"
+								result.Warning(NewError(ClassParse, "no value returned in HTML query"))
 							} else {
 								result.Notification = fmt.Sprintf("an invalid status code has been found: %d", resp.StatusCode)
+								result.Warning(StatusError(resp.StatusCode))
 							}
 						}
 						result.Update = struct {
@@ -0,0 +1,460 @@
+package tasks
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"pkg.goda.sh/utils"
+)
+
+var (
+	// mailPorts are the plain and implicit TLS ports of each mail protocol
+	mailPorts = map[string][2]int{
+		"smtp": {25, 465},
+		"imap": {143, 993},
+		"pop3": {110, 995},
+	}
+	// tlsVersions names TLS versions for results
+	tlsVersions = map[uint16]string{
+		tls.VersionTLS10: "TLS 1.0",
+		tls.VersionTLS11: "TLS 1.1",
+		tls.VersionTLS12: "TLS 1.2",
+		tls.VersionTLS13: "TLS 1.3",
+	}
+)
+
+// mailStep is a command sent to a mail server and its reply, times are in milliseconds
+type mailStep struct {
+	Command string  `json:"command"`
+	Code    string  `json:"code"`
+	Reply   string  `json:"reply,omitempty"`
+	Time    float64 `json:"time"`
+}
+
+// mailConn is a connection to an SMTP, IMAP or POP3 server
+type mailConn struct {
+	proto string
+	host  string
+	conn  net.Conn
+	text  *textproto.Conn
+	tag   int
+	caps  []string
+	steps []mailStep
+}
+
+// SMTP checks a mail server: it reads the greeting, sends EHLO, upgrades with STARTTLS and
+// authenticates when "username" is set
+func SMTP(args *TaskArgs) Result {
+	return mailCheck(args, "smtp")
+}
+
+// IMAP checks an IMAP server: it reads the greeting, asks for its CAPABILITY, upgrades with
+// STARTTLS and logs in when "username" is set
+func IMAP(args *TaskArgs) Result {
+	return mailCheck(args, "imap")
+}
+
+// POP3 checks a POP3 server: it reads the greeting, asks for its CAPA, upgrades with STLS
+// and logs in when "username" is set
+func POP3(args *TaskArgs) Result {
+	return mailCheck(args, "pop3")
+}
+
+// mailCheck runs a mail protocol check. The "tls" param is starttls, implicit or none, it
+// defaults to implicit on the implicit TLS port and starttls otherwise. Error replies fail
+// the check with the reply code, except to the optional POP3 CAPA. Credentials are only
+// sent in clear text with tls none when "insecure" is set
+func mailCheck(args *TaskArgs, proto string) Result {
+	result := NewResult(args.Task)
+	params := utils.ParamsParser(args.Task.Params, utils.DefaultParams{
+		"timeout": "10s",
+	})
+	target := params.Get("target").String()
+	mode := params.Get("tls").String()
+	user := params.Get("username").String()
+	timeout, err := time.ParseDuration(params.Get("timeout").String())
+	switch {
+	case len(target) == 0:
+		err = NewError(ClassConfig, "missing target")
+	case err != nil || timeout <= 0:
+		err = NewError(ClassConfig, "invalid timeout %q", params.Get("timeout").String())
+	case mode != "" && mode != "starttls" && mode != "implicit" && mode != "none":
+		err = NewError(ClassConfig, "invalid tls %q, expected starttls, implicit or none", mode)
+	}
+	insecure, _ := paramBool(args.Task.Params, "insecure")
+	if err == nil && mode == "none" && len(user) > 0 && !insecure {
+		err = NewError(ClassConfig, "credentials would be sent in clear text with tls none, set insecure to allow it")
+	}
+	if err != nil {
+		result.Fail(err)
+		return result
+	}
+	ports := mailPorts[proto]
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host, port = strings.Trim(target, "[]"), strconv.Itoa(ports[0])
+		if mode == "implicit" {
+			port = strconv.Itoa(ports[1])
+		}
+	}
+	if len(mode) == 0 {
+		mode = "starttls"
+		if port == strconv.Itoa(ports[1]) {
+			mode = "implicit"
+		}
+	}
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: insecure,
+	}
+	start := time.Now()
+	m, err := dialMail(proto, net.JoinHostPort(host, port), mode == "implicit", config, timeout)
+	if err == nil {
+		defer m.conn.Close()
+		err = m.session(mode == "starttls", config, user, params.Get("password").String())
+	}
+	elapsed := time.Since(start)
+	if err != nil {
+		result.Fail(err)
+	}
+	result.Warn = result.Error != nil
+	version := ""
+	if c, ok := m.tlsConn(); ok {
+		version = tlsVersions[c.ConnectionState().Version]
+	}
+	result.Spark = &Spark{
+		millis64(elapsed),
+		result.Warn,
+	}
+	result.Update = struct {
+		Greeting     string     `json:"greeting,omitempty"`
+		TLS          string     `json:"tls,omitempty"`
+		Capabilities []string   `json:"capabilities,omitempty"`
+		Steps        []mailStep `json:"steps"`
+		Time         float64    `json:"time"`
+	}{
+		Greeting:     m.greeting(),
+		TLS:          version,
+		Capabilities: m.caps,
+		Steps:        m.steps,
+		Time:         millis64(elapsed),
+	}
+	return result
+}
+
+// dialMail connects to a mail server through TargetPolicy, with TLS for implicit TLS ports
+func dialMail(proto string, address string, implicit bool, config *tls.Config, timeout time.Duration) (*mailConn, error) {
+	m := &mailConn{proto: proto, host: config.ServerName, steps: []mailStep{}}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := TargetPolicy.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return m, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	m.conn = conn
+	if implicit {
+		c := tls.Client(conn, config)
+		if err := c.Handshake(); err != nil {
+			conn.Close()
+			return m, err
+		}
+		m.conn = c
+	}
+	m.text = textproto.NewConn(m.conn)
+	m.record("connect", "", "", start)
+	return m, nil
+}
+
+// session reads the greeting, lists the capabilities, upgrades to TLS, logs in and quits
+func (m *mailConn) session(starttls bool, config *tls.Config, user string, password string) error {
+	if err := m.reply("greeting", time.Now()); err != nil {
+		return err
+	}
+	if err := m.capabilities(); err != nil {
+		return err
+	}
+	if starttls {
+		command := map[string]string{"smtp": "STARTTLS", "imap": "STARTTLS", "pop3": "STLS"}[m.proto]
+		if !m.offers(command) {
+			return NewError(ClassTLS, "%s does not offer %s", m.host, command)
+		}
+		if err := m.command(command, command); err != nil {
+			return err
+		}
+		start := time.Now()
+		c := tls.Client(m.conn, config)
+		if err := c.Handshake(); err != nil {
+			return err
+		}
+		m.conn, m.text = c, textproto.NewConn(c)
+		m.record("tls", "", tlsVersions[c.ConnectionState().Version], start)
+		if err := m.capabilities(); err != nil { // Capabilities change after STARTTLS
+			return err
+		}
+	}
+	if len(user) > 0 {
+		if err := m.login(user, password); err != nil {
+			return err
+		}
+	}
+	quit := map[string]string{"smtp": "QUIT", "imap": "LOGOUT", "pop3": "QUIT"}[m.proto]
+	return m.command(quit, quit)
+}
+
+// capabilities sends EHLO, CAPABILITY or CAPA and keeps the advertised capabilities
+func (m *mailConn) capabilities() error {
+	start := time.Now()
+	switch m.proto {
+	case "smtp":
+		id, err := m.text.Cmd("EHLO %s", strings.ToLower(Project))
+		if err != nil {
+			return err
+		}
+		m.text.StartResponse(id)
+		defer m.text.EndResponse(id)
+		code, msg, err := m.text.ReadResponse(0)
+		if err := m.check("EHLO", strconv.Itoa(code), msg, err, code/100 == 2, start); err != nil {
+			return err
+		}
+		m.caps = strings.Split(msg, "\n")[1:] // The first line is the server name
+	case "imap":
+		untagged, status, msg, err := m.tagged("CAPABILITY")
+		if err := m.check("CAPABILITY", status, msg, err, status == "OK", start); err != nil {
+			return err
+		}
+		m.caps = nil
+		for _, line := range untagged {
+			if strings.HasPrefix(strings.ToUpper(line), "CAPABILITY ") {
+				m.caps = append(m.caps, strings.Fields(line)[1:]...)
+			}
+		}
+	case "pop3":
+		status, msg, err := m.pop3("CAPA")
+		if err == nil && status == "-ERR" { // CAPA is optional, STLS is checked by the caller
+			m.record("CAPA", status, msg, start)
+			m.caps = nil
+			return nil
+		}
+		if err := m.check("CAPA", status, msg, err, status == "+OK", start); err != nil {
+			return err
+		}
+		lines, err := m.text.ReadDotLines()
+		if err != nil {
+			return err
+		}
+		m.caps = lines
+	}
+	return nil
+}
+
+// login authenticates with AUTH PLAIN, LOGIN or USER and PASS, a server that does not
+// offer the mechanism is a protocol error rather than rejected credentials, it warns
+// without cancelling the task as the server may offer it again
+func (m *mailConn) login(user string, password string) error {
+	start := time.Now()
+	switch m.proto {
+	case "smtp":
+		mechanisms := m.mechanisms()
+		if !inStrings(mechanisms, "PLAIN") {
+			if len(mechanisms) == 0 {
+				return NewError(ClassProtocol, "%s does not offer AUTH", m.host)
+			}
+			return NewError(ClassProtocol, "%s does not offer AUTH PLAIN, only %s", m.host, strings.Join(mechanisms, ", "))
+		}
+		plain := base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + password))
+		id, err := m.text.Cmd("AUTH PLAIN %s", plain)
+		if err != nil {
+			return err
+		}
+		m.text.StartResponse(id)
+		defer m.text.EndResponse(id)
+		code, msg, err := m.text.ReadResponse(0)
+		return m.authError(m.check("AUTH PLAIN", strconv.Itoa(code), msg, err, code == 235, start))
+	case "imap":
+		if m.offers("LOGINDISABLED") {
+			return NewError(ClassProtocol, "%s does not allow LOGIN", m.host)
+		}
+		_, status, msg, err := m.tagged(fmt.Sprintf("LOGIN %s %s", imapQuote(user), imapQuote(password)))
+		return m.authError(m.check("LOGIN", status, msg, err, status == "OK", start))
+	default:
+		status, msg, err := m.pop3("USER " + user)
+		if err := m.check("USER", status, msg, err, status == "+OK", start); err != nil {
+			return m.authError(err)
+		}
+		start = time.Now()
+		status, msg, err = m.pop3("PASS " + password)
+		return m.authError(m.check("PASS", status, msg, err, status == "+OK", start))
+	}
+}
+
+// command sends a command that expects a single success reply, name is how it is recorded
+func (m *mailConn) command(name string, command string) error {
+	start := time.Now()
+	switch m.proto {
+	case "smtp":
+		id, err := m.text.Cmd("%s", command)
+		if err != nil {
+			return err
+		}
+		m.text.StartResponse(id)
+		defer m.text.EndResponse(id)
+		code, msg, err := m.text.ReadResponse(0)
+		return m.check(name, strconv.Itoa(code), msg, err, code/100 == 2, start)
+	case "imap":
+		_, status, msg, err := m.tagged(command)
+		return m.check(name, status, msg, err, status == "OK", start)
+	default:
+		status, msg, err := m.pop3(command)
+		return m.check(name, status, msg, err, status == "+OK", start)
+	}
+}
+
+// reply reads the greeting of the server
+func (m *mailConn) reply(name string, start time.Time) error {
+	switch m.proto {
+	case "smtp":
+		code, msg, err := m.text.ReadResponse(0)
+		return m.check(name, strconv.Itoa(code), msg, err, code == 220, start)
+	case "imap":
+		line, err := m.text.ReadLine()
+		status, msg := mailStatus(strings.TrimPrefix(line, "* "))
+		return m.check(name, status, msg, err, status == "OK" || status == "PREAUTH", start)
+	default:
+		line, err := m.text.ReadLine()
+		status, msg := mailStatus(line)
+		return m.check(name, status, msg, err, status == "+OK", start)
+	}
+}
+
+// tagged sends an IMAP command and reads the untagged lines up to its tagged status
+func (m *mailConn) tagged(command string) ([]string, string, string, error) {
+	m.tag++
+	tag := fmt.Sprintf("a%d", m.tag)
+	if err := m.text.PrintfLine("%s %s", tag, command); err != nil {
+		return nil, "", "", err
+	}
+	untagged := []string{}
+	for {
+		line, err := m.text.ReadLine()
+		if err != nil {
+			return untagged, "", "", err
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			status, msg := mailStatus(line[len(tag)+1:])
+			return untagged, status, msg, nil
+		}
+		untagged = append(untagged, strings.TrimPrefix(line, "* "))
+	}
+}
+
+// pop3 sends a POP3 command and reads its status line
+func (m *mailConn) pop3(command string) (string, string, error) {
+	if err := m.text.PrintfLine("%s", command); err != nil {
+		return "", "", err
+	}
+	line, err := m.text.ReadLine()
+	status, msg := mailStatus(line)
+	return status, msg, err
+}
+
+// check records a reply, it returns an error when reading failed or the reply is not a
+// success reply
+func (m *mailConn) check(name string, code string, msg string, err error, ok bool, start time.Time) error {
+	if err != nil {
+		if _, protocol := err.(*textproto.Error); !protocol {
+			return err
+		}
+	}
+	if code == "0" {
+		code = ""
+	}
+	m.record(name, code, msg, start)
+	if !ok {
+		return NewError(ClassProtocol, "%s %s replied to %s with %s %s", strings.ToUpper(m.proto), m.host, name, code, firstLine(msg))
+	}
+	return nil
+}
+
+// authError reclassifies a rejected login as a permission error
+func (m *mailConn) authError(err error) error {
+	if te, ok := err.(*TaskError); ok && te.Class == ClassProtocol {
+		return NewError(ClassPermission, "%s", te.Message)
+	}
+	return err
+}
+
+// record adds a step to the results
+func (m *mailConn) record(name string, code string, msg string, start time.Time) {
+	m.steps = append(m.steps, mailStep{
+		Command: name,
+		Code:    code,
+		Reply:   firstLine(msg),
+		Time:    millis64(time.Since(start)),
+	})
+}
+
+// offers reports if the server advertised a capability
+func (m *mailConn) offers(capability string) bool {
+	for _, c := range m.caps {
+		if f := strings.Fields(c); len(f) > 0 && strings.EqualFold(f[0], capability) {
+			return true
+		}
+	}
+	return false
+}
+
+// mechanisms returns the upper case SASL mechanisms of the SMTP AUTH capability
+func (m *mailConn) mechanisms() []string {
+	mechanisms := []string{}
+	for _, c := range m.caps {
+		f := strings.Fields(strings.ToUpper(strings.Replace(c, "=", " ", 1))) // Old servers send AUTH=PLAIN
+		if len(f) > 0 && f[0] == "AUTH" {
+			mechanisms = append(mechanisms, f[1:]...)
+		}
+	}
+	return mechanisms
+}
+
+// greeting returns the greeting reply of the server
+func (m *mailConn) greeting() string {
+	for _, s := range m.steps {
+		if s.Command == "greeting" {
+			return s.Reply
+		}
+	}
+	return ""
+}
+
+// tlsConn returns the TLS connection once the connection is encrypted
+func (m *mailConn) tlsConn() (*tls.Conn, bool) {
+	c, ok := m.conn.(*tls.Conn)
+	return c, ok
+}
+
+// mailStatus splits an IMAP or POP3 status line such as "OK done" or "+OK ready"
+func mailStatus(line string) (string, string) {
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) == 1 {
+		return strings.ToUpper(parts[0]), ""
+	}
+	return strings.ToUpper(parts[0]), parts[1]
+}
+
+// imapQuote quotes an IMAP string
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// firstLine returns the first line of a possibly multi-line reply
+func firstLine(s string) string {
+	return strings.SplitN(s, "\n", 2)[0]
+}
@@ -4,13 +4,18 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"text/template"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/tidwall/gjson"
+	"pkg.goda.sh/utils"
 )
 
 var (
@@ -23,23 +28,35 @@ var (
 	TaskMapping = map[string][]string{}
 	// TaskRunners defines the different types of tasks for the task runner
 	TaskRunners = map[string]Type{
-		"port":          {Port, "port", false},
-		"fakeport":      {FakePort, "port", false},
-		"ping":          {Ping, "ping", false},
-		"http":          {HTTP, "http", false},
-		"http-json":     {HTTPJSON, "http", false},
-		"http-status":   {HTTPStatus, "http", false},
-		"http-regex":    {HTTPREGEXP, "http", false},
-		"http-regexp":   {HTTPREGEXP, "http", false},
-		"fakeping":      {FakePing, "ping", false},
-		"media":         {Media, "media", false},
-		"iframe":        {Media, "media", false},
-		"feed":          {Feed, "feed", false},
-		"fakefeed":      {FakeFeed, "feed", false},
-		"dns":           {DNS, "dns", false},
-		"dns-cidr":      {DNSCIDR, "dns", false},
-		"counter":       {Counter, "counter", true},      // Triggered by callbacks
-		"redis-counter": {RedisCounter, "counter", true}, // Triggered by callbacks
+		"port":              {Port, "port", false},
+		"fakeport":          {FakePort, "port", false},
+		"ping":              {Ping, "ping", false},
+		"tcp-ping":          {TCPPing, "ping", false},
+		"traceroute":        {Traceroute, "traceroute", false},
+		"ssh":               {SSH, "ssh", false},
+		"smtp":              {SMTP, "mail", false},
+		"imap":              {IMAP, "mail", false},
+		"pop3":              {POP3, "mail", false},
+		"grpc-health":       {GRPCHealth, "grpc", false},
+		"grpc-health-watch": {GRPCHealthWatch, "grpc", true}, // Triggered by the Watch stream
+		"websocket":         {WebSocket, "websocket", false},
+		"ntp":               {NTP, "ntp", false},
+		"http":              {HTTP, "http", false},
+		"http-json":         {HTTPJSON, "http", false},
+		"http-status":       {HTTPStatus, "http", false},
+		"http-regex":        {HTTPREGEXP, "http", false},
+		"http-regexp":       {HTTPREGEXP, "http", false},
+		"fakeping":          {FakePing, "ping", false},
+		"media":             {Media, "media", false},
+		"iframe":            {Media, "media", false},
+		"feed":              {Feed, "feed", false},
+		"fakefeed":          {FakeFeed, "feed", false},
+		"dns":               {DNS, "dns", false},
+		"dns-cidr":          {DNSCIDR, "dns", false},
+		"counter":           {Counter, "counter", true},      // Triggered by callbacks
+		"redis-counter":     {RedisCounter, "counter", true}, // Triggered by callbacks
+		"prometheus":        {Prometheus, "http", false},
+		"promql":            {PromQL, "http", false},
 	}
 )
 
@@ -159,7 +176,7 @@ type Redis struct {
 
 // Type binds a method to a UI type
 type Type struct {
-	Func      func(*TaskArgs) Result
+	Func      RunnerFunc
 	Type      string `json:"type"`
 	Timerless bool   `json:"timerless"` // Triggered by callbacks
 }
@@ -169,16 +186,88 @@ func Timerless(task string) bool {
 	return TaskRunners[task].Timerless
 }
 
-// CreateRequest generates HTTP requests for tasks
+// CreateRequest generates HTTP requests for tasks, the client verifies certificates
 func CreateRequest(method string, url string, body io.Reader) (*http.Request, *http.Client) {
 	req, _ := http.NewRequest(method, url, body)
 	req.Header.Set("User-Agent", fmt.Sprintf("%s/%s", Project, Version)) // Add a default user agent
-	client := &http.Client{
+	return req, newClient(false)
+}
+
+// CreateTaskRequest generates HTTP requests for tasks, the client accepts invalid
+// certificates when the task sets the "insecure" param
+func CreateTaskRequest(method string, url string, body io.Reader, params map[string]interface{}) (*http.Request, *http.Client) {
+	req, client := CreateRequest(method, url, body)
+	if insecure, _ := paramBool(params, "insecure"); insecure {
+		client = newClient(true)
+	}
+	return req, client
+}
+
+// newClient creates the HTTP client for tasks, connections are checked against TargetPolicy
+func newClient(insecure bool) *http.Client {
+	return &http.Client{
 		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				return TargetPolicy.DialContext(ctx, network, address)
+			},
 			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true, // Accept any invalid certs
+				InsecureSkipVerify: insecure,
 			},
 		},
 	}
+}
+
+// CreateAuthRequest generates HTTP requests for tasks, adding basic auth from the
+// "username" and "password" params or a bearer token from the "bearer" param
+func CreateAuthRequest(method string, url string, body io.Reader, params map[string]interface{}) (*http.Request, *http.Client) {
+	req, client := CreateTaskRequest(method, url, body, params)
+	p := utils.ParamsParser(params)
+	if token := p.Get("bearer").String(); len(token) > 0 {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	} else if user := p.Get("username").String(); len(user) > 0 {
+		req.SetBasicAuth(user, p.Get("password").String())
+	}
 	return req, client
 }
+
+// paramFloat reads a numeric task param, ok is false when it is missing or not a number
+func paramFloat(params map[string]interface{}, key string) (float64, bool) {
+	switch v := params[key].(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// paramBool reads a boolean task param, ok is false when it is missing or not a boolean
+func paramBool(params map[string]interface{}, key string) (bool, bool) {
+	switch v := params[key].(type) {
+	case bool:
+		return v, true
+	case string:
+		b, err := strconv.ParseBool(v)
+		return b, err == nil
+	}
+	return false, false
+}
+
+// lastUpdate reads a value from the previous update of a task, e.g. "hops.#.addr"
+func lastUpdate(last interface{}, path string) gjson.Result {
+	if last == nil {
+		return gjson.Result{}
+	}
+	b, err := json.Marshal(last)
+	if err != nil {
+		return gjson.Result{}
+	}
+	return gjson.GetBytes(b, path)
+}
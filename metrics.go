@@ -0,0 +1,178 @@
+package tasks
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// metricLabels are the labels added to every task metric
+	metricLabels = []string{"type", "task", "id", "label", "location"}
+)
+
+// Exporter turns the latest result of every task into Prometheus metrics
+type Exporter struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+	up       *prometheus.GaugeVec
+	warn     *prometheus.GaugeVec
+	spark    *prometheus.GaugeVec
+	loss     *prometheus.GaugeVec
+	rtt      *prometheus.GaugeVec
+	jitter   *prometheus.GaugeVec
+	count    *prometheus.GaugeVec
+	latency  *prometheus.HistogramVec
+	duration *prometheus.HistogramVec
+	runs     *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+}
+
+// NewExporter creates an exporter with its own registry
+func NewExporter() *Exporter {
+	gauge := func(name string, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "godash",
+			Name:      name,
+			Help:      help,
+		}, metricLabels)
+	}
+	e := &Exporter{
+		registry: prometheus.NewRegistry(),
+		up:       gauge("task_up", "1 if the last run of the task had no error."),
+		warn:     gauge("task_warn", "1 if the last run of the task raised a warning."),
+		spark:    gauge("task_spark_value", "Sparkline value of the last run of the task."),
+		loss:     gauge("ping_loss_percent", "Packet loss of the last ping."),
+		rtt:      gauge("ping_rtt_seconds", "Average round trip time of the last ping."),
+		jitter:   gauge("ping_jitter_seconds", "Round trip time standard deviation of the last ping."),
+		count:    gauge("counter_value", "Value of a counter task."),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "godash",
+			Name:      "http_duration_seconds",
+			Help:      "Time taken by HTTP tasks.",
+			Buckets:   prometheus.DefBuckets,
+		}, metricLabels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "godash",
+			Name:      "runner_duration_seconds",
+			Help:      "Time taken to execute task runners.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"type", "task"}),
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "godash",
+			Name:      "runner_runs_total",
+			Help:      "Task runner executions.",
+		}, []string{"type", "task"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "godash",
+			Name:      "runner_errors_total",
+			Help:      "Task runner executions that returned an error.",
+		}, []string{"type", "task"}),
+	}
+	e.registry.MustRegister(e.up, e.warn, e.spark, e.loss, e.rtt, e.jitter, e.count, e.latency, e.duration, e.runs, e.errors)
+	e.handler = promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{})
+	return e
+}
+
+// ServeHTTP serves the metrics in the Prometheus exposition format
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.handler.ServeHTTP(w, r)
+}
+
+// Record updates the metrics of a task from its latest result, took is the runner
+// execution time and is skipped when zero, e.g. for results sent by callbacks
+func (e *Exporter) Record(result Result, took time.Duration) {
+	kind := TaskRunners[result.Task].Type
+	labels := prometheus.Labels{
+		"type":     kind,
+		"task":     result.Task,
+		"id":       result.ID,
+		"label":    result.Label,
+		"location": result.Location,
+	}
+	if took > 0 {
+		e.runs.WithLabelValues(kind, result.Task).Inc()
+		if result.Error != nil {
+			e.errors.WithLabelValues(kind, result.Task).Inc()
+		}
+		e.duration.WithLabelValues(kind, result.Task).Observe(took.Seconds())
+		if kind == "http" {
+			e.latency.With(labels).Observe(took.Seconds())
+		}
+	}
+	e.up.With(labels).Set(boolGauge(result.Error == nil))
+	e.warn.With(labels).Set(boolGauge(result.Warn))
+	if result.Spark != nil {
+		if v, ok := number(result.Spark.Value); ok {
+			e.spark.With(labels).Set(v)
+		}
+	}
+	if result.Update == nil {
+		return
+	}
+	update, err := json.Marshal(result.Update)
+	if err != nil {
+		return
+	}
+	switch kind {
+	case "ping":
+		if v := gjson.GetBytes(update, "loss"); v.Exists() {
+			e.loss.With(labels).Set(v.Float())
+		}
+		if v := gjson.GetBytes(update, "avg"); v.Exists() {
+			e.rtt.With(labels).Set(v.Float() / 1000)
+		}
+		if v := gjson.GetBytes(update, "jitt"); v.Exists() {
+			e.jitter.With(labels).Set(v.Float() / 1000)
+		}
+	case "counter":
+		if v := gjson.GetBytes(update, "count"); v.Exists() {
+			e.count.With(labels).Set(v.Float())
+		}
+	}
+}
+
+// Forget drops every metric of a task, e.g. once it has been removed
+func (e *Exporter) Forget(task Task) {
+	labels := prometheus.Labels{
+		"type":     TaskRunners[task.Task].Type,
+		"task":     task.Task,
+		"id":       task.ID,
+		"label":    task.Label,
+		"location": task.Location,
+	}
+	for _, g := range []*prometheus.GaugeVec{e.up, e.warn, e.spark, e.loss, e.rtt, e.jitter, e.count} {
+		g.Delete(labels)
+	}
+	e.latency.Delete(labels)
+}
+
+// boolGauge converts a bool to a gauge value
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// number converts a numeric spark value to a float
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,158 @@
+package tasks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"pkg.goda.sh/utils"
+)
+
+var (
+	// ntpEpoch is the start of NTP time, timestamps are seconds since 1900
+	ntpEpoch = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// NTP queries an NTP server with SNTP and reports the clock offset, round trip delay,
+// stratum and reference ID. It warns when the absolute offset exceeds "max_offset" or the
+// server is not synchronized, the offset in milliseconds is used as the spark
+func NTP(args *TaskArgs) Result {
+	result := NewResult(args.Task)
+	params := utils.ParamsParser(args.Task.Params, utils.DefaultParams{
+		"timeout":    "5s",
+		"max_offset": "100ms",
+	})
+	target := params.Get("target").String()
+	timeout, err := time.ParseDuration(params.Get("timeout").String())
+	if err != nil || timeout <= 0 {
+		result.Fail(NewError(ClassConfig, "invalid timeout %q", params.Get("timeout").String()))
+		return result
+	}
+	maxOffset, err := time.ParseDuration(params.Get("max_offset").String())
+	if err != nil || maxOffset <= 0 {
+		result.Fail(NewError(ClassConfig, "invalid max_offset %q", params.Get("max_offset").String()))
+		return result
+	}
+	if len(target) == 0 {
+		result.Fail(NewError(ClassConfig, "missing target"))
+		return result
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(strings.Trim(target, "[]"), "123")
+	}
+	r, err := ntpQuery(target, timeout)
+	if err != nil {
+		result.Fail(err)
+		result.Warn = true
+		return result
+	}
+	problems := []string{}
+	if time.Duration(math.Abs(float64(r.offset))) > maxOffset {
+		problems = append(problems, fmt.Sprintf("clock offset is %s, more than %s", r.offset, maxOffset))
+	}
+	if r.leap == 3 {
+		problems = append(problems, "server clock is not synchronized")
+	}
+	result.Warn = len(problems) > 0
+	if result.Warn {
+		result.Notification = fmt.Sprintf("NTP check of %s: %s!", target, strings.Join(problems, ", "))
+	}
+	result.Spark = &Spark{
+		millis64(r.offset),
+		result.Warn,
+	}
+	result.Update = struct {
+		Offset  float64 `json:"offset"`
+		Delay   float64 `json:"delay"`
+		Stratum int     `json:"stratum"`
+		RefID   string  `json:"refid"`
+		Leap    int     `json:"leap"`
+	}{
+		Offset:  millis64(r.offset),
+		Delay:   millis64(r.delay),
+		Stratum: r.stratum,
+		RefID:   r.refID,
+		Leap:    r.leap,
+	}
+	return result
+}
+
+// ntpResponse is the parsed reply of an NTP server
+type ntpResponse struct {
+	offset  time.Duration
+	delay   time.Duration
+	stratum int
+	refID   string
+	leap    int
+}
+
+// ntpQuery sends an SNTP v4 client request through TargetPolicy and parses the reply,
+// replies that do not echo the request timestamp are ignored
+func ntpQuery(target string, timeout time.Duration) (*ntpResponse, error) {
+	conn, err := TargetPolicy.Dial("udp", target, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	req := make([]byte, 48)
+	req[0] = 4<<3 | 3 // Version 4, client mode
+	sent := time.Now()
+	binary.BigEndian.PutUint64(req[40:], ntpTime(sent))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		received := time.Now()
+		resp := buf[:n]
+		if n < 48 || !bytes.Equal(resp[24:32], req[40:48]) || resp[0]&7 != 4 {
+			continue // Not a server reply to this request
+		}
+		r := &ntpResponse{
+			stratum: int(resp[1]),
+			leap:    int(resp[0] >> 6),
+		}
+		if r.stratum == 0 { // Kiss-o'-Death, the reference ID holds the code such as RATE
+			return nil, NewError(ClassProtocol, "NTP server sent kiss code %s", strings.TrimRight(string(resp[12:16]), "\x00"))
+		}
+		if r.stratum == 1 {
+			r.refID = strings.TrimRight(string(resp[12:16]), "\x00")
+		} else {
+			r.refID = net.IP(resp[12:16]).String()
+		}
+		t1 := sent
+		t2 := ntpEpoch.Add(ntpDuration(binary.BigEndian.Uint64(resp[32:])))
+		t3 := ntpEpoch.Add(ntpDuration(binary.BigEndian.Uint64(resp[40:])))
+		t4 := t1.Add(received.Sub(sent)) // Monotonic, immune to clock steps during the query
+		r.offset = (t2.Sub(t1) + t3.Sub(t4)) / 2
+		r.delay = t4.Sub(t1) - t3.Sub(t2)
+		if r.delay < 0 {
+			r.delay = 0
+		}
+		return r, nil
+	}
+}
+
+// ntpTime converts a time to a 64 bit NTP timestamp
+func ntpTime(t time.Time) uint64 {
+	d := t.Sub(ntpEpoch)
+	sec := uint64(d / time.Second)
+	frac := uint64(d%time.Second) << 32 / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+// ntpDuration converts a 64 bit NTP timestamp to the time since the NTP epoch
+func ntpDuration(ts uint64) time.Duration {
+	sec := time.Duration(ts>>32) * time.Second
+	frac := time.Duration((ts & 0xffffffff) * uint64(time.Second) >> 32)
+	return sec + frac
+}
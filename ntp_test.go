@@ -0,0 +1,134 @@
+package tasks
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// ntpServer starts a local UDP stand-in for an NTP server whose clock is off by skew. It
+// holds each request for hold before replying and sends a reply with the wrong origin
+// timestamp first when spoof is set
+func ntpServer(t *testing.T, skew time.Duration, hold time.Duration, stratum byte, refID []byte, spoof bool) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		req := make([]byte, 48)
+		for {
+			n, addr, err := conn.ReadFromUDP(req)
+			if err != nil {
+				return
+			}
+			if n < 48 {
+				continue
+			}
+			received := time.Now().Add(skew)
+			resp := make([]byte, 48)
+			resp[0] = 4<<3 | 4 // Version 4, server mode
+			resp[1] = stratum
+			copy(resp[12:16], refID)
+			if spoof {
+				conn.WriteToUDP(resp, addr) // Origin timestamp is zero
+			}
+			copy(resp[24:32], req[40:48])
+			binary.BigEndian.PutUint64(resp[32:], ntpTime(received))
+			time.Sleep(hold)
+			binary.BigEndian.PutUint64(resp[40:], ntpTime(received.Add(hold)))
+			conn.WriteToUDP(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestNTP(t *testing.T) {
+	tests := []struct {
+		name    string
+		skew    time.Duration
+		stratum byte
+		refID   []byte
+		spoof   bool
+		params  map[string]interface{}
+		warn    bool
+		wantRef string
+	}{
+		{
+			name:    "primary server in sync",
+			stratum: 1,
+			refID:   []byte("GPS\x00"),
+			wantRef: "GPS",
+		},
+		{
+			name:    "spoofed reply is ignored",
+			stratum: 1,
+			refID:   []byte("PPS\x00"),
+			spoof:   true,
+			wantRef: "PPS",
+		},
+		{
+			name:    "offset over the default limit",
+			skew:    -300 * time.Millisecond,
+			stratum: 2,
+			refID:   []byte{10, 0, 0, 1},
+			warn:    true,
+			wantRef: "10.0.0.1",
+		},
+		{
+			name:    "offset within max_offset",
+			skew:    3 * time.Second,
+			stratum: 3,
+			refID:   []byte{192, 0, 2, 1},
+			params:  map[string]interface{}{"max_offset": "5s"},
+			wantRef: "192.0.2.1",
+		},
+	}
+	hold := 5 * time.Millisecond
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := map[string]interface{}{"target": ntpServer(t, tt.skew, hold, tt.stratum, tt.refID, tt.spoof)}
+			for k, v := range tt.params {
+				params[k] = v
+			}
+			result := Run(&TaskArgs{Task: Task{ID: "ntp", Task: "ntp", Params: params}})
+			if result.Error != nil {
+				t.Fatal(result.Error)
+			}
+			if result.Warn != tt.warn {
+				t.Fatalf("warn = %t, want %t: %s", result.Warn, tt.warn, result.Notification)
+			}
+			offset := lastUpdate(result.Update, "offset").Float()
+			if want := millis64(tt.skew); math.Abs(offset-want) > 20 {
+				t.Errorf("offset = %.3fms, want about %.3fms", offset, want)
+			}
+			if delay := lastUpdate(result.Update, "delay").Float(); delay < 0 || delay > 20 {
+				t.Errorf("delay = %.3fms, want the round trip without the %s hold", delay, hold)
+			}
+			if got := lastUpdate(result.Update, "stratum").Int(); got != int64(tt.stratum) {
+				t.Errorf("stratum = %d, want %d", got, tt.stratum)
+			}
+			if got := lastUpdate(result.Update, "refid").String(); got != tt.wantRef {
+				t.Errorf("refid = %q, want %q", got, tt.wantRef)
+			}
+		})
+	}
+}
+
+func TestNTPKissCode(t *testing.T) {
+	target := ntpServer(t, 0, 0, 0, []byte("RATE"), false)
+	result := Run(&TaskArgs{Task: Task{ID: "ntp", Task: "ntp", Params: map[string]interface{}{"target": target}}})
+	if te := ClassifyError(result.Error); te == nil || te.Class != ClassProtocol || !result.Warn {
+		t.Fatalf("got %+v", result)
+	}
+}
+
+func TestNTPTime(t *testing.T) {
+	want := time.Unix(1700000000, 123456789)
+	if diff := ntpEpoch.Add(ntpDuration(ntpTime(want))).Sub(want); diff > time.Nanosecond || diff < -time.Nanosecond {
+		t.Fatalf("round trip is off by %s", diff)
+	}
+}
@@ -0,0 +1,329 @@
+package tasks
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParamKind is the type a task param must have
+type ParamKind string
+
+const (
+	// ParamString is a string
+	ParamString ParamKind = "string"
+	// ParamInt is a whole number
+	ParamInt ParamKind = "int"
+	// ParamNumber is any number, numeric strings are accepted
+	ParamNumber ParamKind = "number"
+	// ParamBool is true or false
+	ParamBool ParamKind = "bool"
+	// ParamList is a list of values
+	ParamList ParamKind = "list"
+	// ParamMap is a map of values
+	ParamMap ParamKind = "map"
+	// ParamDuration is a Go duration string such as "1m30s"
+	ParamDuration ParamKind = "duration"
+	// ParamAny is not checked
+	ParamAny ParamKind = "any"
+)
+
+// Param describes a task param for config validation
+type Param struct {
+	Kind     ParamKind
+	Required bool
+	Values   []string // Allowed values of string params
+}
+
+// ParamError is a task param that failed validation
+type ParamError struct {
+	Param   string
+	Message string
+}
+
+// Error returns the error message
+func (e ParamError) Error() string {
+	return fmt.Sprintf("param %q %s", e.Param, e.Message)
+}
+
+var (
+	// authParams are accepted by tasks that use CreateAuthRequest
+	authParams = map[string]Param{
+		"bearer":   {Kind: ParamString},
+		"username": {Kind: ParamString},
+		"password": {Kind: ParamString},
+		"insecure": {Kind: ParamBool},
+	}
+	// dnsParams are accepted by the DNS over HTTPS tasks
+	dnsParams = map[string]Param{
+		"provider": {Kind: ParamString},
+		"target":   {Kind: ParamString},
+		"request":  {Kind: ParamString},
+		"insecure": {Kind: ParamBool},
+	}
+	// mailParams are accepted by the SMTP, IMAP and POP3 tasks
+	mailParams = map[string]Param{
+		"target":   {Kind: ParamString, Required: true},
+		"tls":      {Kind: ParamString, Values: []string{"starttls", "implicit", "none"}},
+		"insecure": {Kind: ParamBool},
+		"username": {Kind: ParamString},
+		"password": {Kind: ParamString},
+		"timeout":  {Kind: ParamDuration},
+	}
+	// grpcParams are accepted by the gRPC health tasks
+	grpcParams = map[string]Param{
+		"target":      {Kind: ParamString, Required: true},
+		"service":     {Kind: ParamString},
+		"tls":         {Kind: ParamBool},
+		"insecure":    {Kind: ParamBool},
+		"server_name": {Kind: ParamString},
+		"ca":          {Kind: ParamString},
+		"cert":        {Kind: ParamString},
+		"key":         {Kind: ParamString},
+		"metadata":    {Kind: ParamMap},
+		"timeout":     {Kind: ParamDuration},
+	}
+	// TaskParams describes the params of each task type, task types without an entry
+	// accept any params
+	TaskParams = map[string]map[string]Param{
+		"port": {
+			"target":      {Kind: ParamString},
+			"targets":     {Kind: ParamList},
+			"ports":       {Kind: ParamList},
+			"state":       {Kind: ParamString, Values: []string{"open", "closed"}},
+			"concurrency": {Kind: ParamInt},
+			"method":      {Kind: ParamString, Values: []string{"tcp", "tcp4", "tcp6", "udp", "udp4", "udp6"}},
+			"timeout":     {Kind: ParamInt},
+			"send":        {Kind: ParamString},
+			"expect":      {Kind: ParamString},
+			"banner":      {Kind: ParamBool},
+		},
+		"fakeport": {},
+		"ping": {
+			"target":     {Kind: ParamString, Required: true},
+			"count":      {Kind: ParamInt},
+			"high":       {Kind: ParamInt},
+			"network":    {Kind: ParamString, Values: []string{"ip", "ip4", "ip6"}},
+			"interval":   {Kind: ParamDuration},
+			"timeout":    {Kind: ParamDuration},
+			"size":       {Kind: ParamInt},
+			"ttl":        {Kind: ParamInt},
+			"source":     {Kind: ParamString},
+			"privileged": {Kind: ParamBool},
+			"protocol":   {Kind: ParamString, Values: []string{"icmp", "tcp"}},
+			"port":       {Kind: ParamInt},
+		},
+		"tcp-ping": {
+			"target":   {Kind: ParamString, Required: true},
+			"port":     {Kind: ParamInt},
+			"count":    {Kind: ParamInt},
+			"high":     {Kind: ParamInt},
+			"network":  {Kind: ParamString, Values: []string{"ip", "ip4", "ip6"}},
+			"interval": {Kind: ParamDuration},
+			"timeout":  {Kind: ParamDuration},
+		},
+		"traceroute": {
+			"target":   {Kind: ParamString, Required: true},
+			"protocol": {Kind: ParamString, Values: []string{"udp", "icmp", "tcp"}},
+			"port":     {Kind: ParamInt},
+			"max_hops": {Kind: ParamInt},
+			"queries":  {Kind: ParamInt},
+			"timeout":  {Kind: ParamDuration},
+			"loss":     {Kind: ParamNumber},
+			"rdns":     {Kind: ParamBool},
+		},
+		"ssh": {
+			"target":              {Kind: ParamString, Required: true},
+			"timeout":             {Kind: ParamDuration},
+			"user":                {Kind: ParamString},
+			"key":                 {Kind: ParamString},
+			"passphrase":          {Kind: ParamString},
+			"fingerprint":         {Kind: ParamAny},
+			"host_key_algorithms": {Kind: ParamList},
+			"auth_methods":        {Kind: ParamList},
+		},
+		"smtp":              mailParams,
+		"imap":              mailParams,
+		"pop3":              mailParams,
+		"grpc-health":       grpcParams,
+		"grpc-health-watch": grpcParams,
+		"ntp": {
+			"target":     {Kind: ParamString, Required: true},
+			"timeout":    {Kind: ParamDuration},
+			"max_offset": {Kind: ParamDuration},
+		},
+		"websocket": {
+			"url":          {Kind: ParamString, Required: true},
+			"headers":      {Kind: ParamMap},
+			"subprotocols": {Kind: ParamList},
+			"send":         {Kind: ParamString},
+			"expect":       {Kind: ParamString},
+			"query":        {Kind: ParamString},
+			"value":        {Kind: ParamAny},
+			"insecure":     {Kind: ParamBool},
+			"timeout":      {Kind: ParamDuration},
+		},
+		"fakeping": {
+			"high":  {Kind: ParamInt},
+			"range": {Kind: ParamList},
+		},
+		"http": {
+			"url":      {Kind: ParamString, Required: true},
+			"insecure": {Kind: ParamBool},
+		},
+		"http-json": {
+			"url":      {Kind: ParamString, Required: true},
+			"query":    {Kind: ParamString, Required: true},
+			"insecure": {Kind: ParamBool},
+		},
+		"http-status": {
+			"url":      {Kind: ParamString, Required: true},
+			"codes":    {Kind: ParamList, Required: true},
+			"insecure": {Kind: ParamBool},
+		},
+		"http-regex": {
+			"url":      {Kind: ParamString, Required: true},
+			"regex":    {Kind: ParamString},
+			"insecure": {Kind: ParamBool},
+		},
+		"media": {
+			"url":  {Kind: ParamString, Required: true},
+			"type": {Kind: ParamString},
+		},
+		"feed": {
+			"url":      {Kind: ParamString, Required: true},
+			"limit":    {Kind: ParamInt},
+			"insecure": {Kind: ParamBool},
+		},
+		"fakefeed": {
+			"limit": {Kind: ParamInt},
+		},
+		"dns":      dnsParams,
+		"dns-cidr": withParams(dnsParams, map[string]Param{"ranges": {Kind: ParamList, Required: true}}),
+		"counter": {
+			"token": {Kind: ParamString, Required: true},
+		},
+		"prometheus": withParams(authParams, map[string]Param{
+			"url":       {Kind: ParamString, Required: true},
+			"query":     {Kind: ParamString},
+			"aggregate": {Kind: ParamString, Values: []string{"sum", "avg", "min", "max", "count"}},
+			"high":      {Kind: ParamNumber},
+			"low":       {Kind: ParamNumber},
+		}),
+		"promql": withParams(authParams, map[string]Param{
+			"url":   {Kind: ParamString, Required: true},
+			"query": {Kind: ParamString, Required: true},
+			"type":  {Kind: ParamString, Values: []string{"instant", "range"}},
+			"range": {Kind: ParamDuration},
+			"step":  {Kind: ParamString},
+			"limit": {Kind: ParamInt},
+			"high":  {Kind: ParamNumber},
+			"low":   {Kind: ParamNumber},
+		}),
+	}
+)
+
+func init() {
+	// Aliases share the params of the task they run
+	TaskParams["http-regexp"] = TaskParams["http-regex"]
+	TaskParams["iframe"] = TaskParams["media"]
+	TaskParams["redis-counter"] = TaskParams["counter"]
+}
+
+// withParams merges param sets into a new one
+func withParams(sets ...map[string]Param) map[string]Param {
+	out := map[string]Param{}
+	for _, set := range sets {
+		for k, p := range set {
+			out[k] = p
+		}
+	}
+	return out
+}
+
+// ValidateParams checks task params against TaskParams, secret references are accepted
+// for any kind as they are only resolved at run time
+func ValidateParams(task string, params map[string]interface{}) []ParamError {
+	schema, ok := TaskParams[task]
+	if !ok {
+		return nil
+	}
+	errs := []ParamError{}
+	for name, p := range schema {
+		if _, ok := params[name]; p.Required && !ok {
+			errs = append(errs, ParamError{name, "is required"})
+		}
+	}
+	for name, v := range params {
+		p, ok := schema[name]
+		if !ok {
+			errs = append(errs, ParamError{name, fmt.Sprintf("is not supported by %s tasks", task)})
+			continue
+		}
+		if s, ok := v.(string); ok && secretRef.MatchString(s) {
+			continue
+		}
+		if msg := p.check(v); len(msg) > 0 {
+			errs = append(errs, ParamError{name, msg})
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Param < errs[j].Param
+	})
+	return errs
+}
+
+// check returns why a value does not match the param, or an empty string
+func (p Param) check(v interface{}) string {
+	ok := true
+	switch p.Kind {
+	case ParamString:
+		s, isString := v.(string)
+		ok = isString
+		if ok && len(p.Values) > 0 && !inStrings(p.Values, s) {
+			return fmt.Sprintf("must be one of %s", strings.Join(p.Values, ", "))
+		}
+	case ParamInt:
+		f, isNumber := v.(float64)
+		ok = isNumber && f == math.Trunc(f)
+	case ParamNumber:
+		switch v := v.(type) {
+		case float64:
+		case string:
+			_, err := strconv.ParseFloat(v, 64)
+			ok = err == nil
+		default:
+			ok = false
+		}
+	case ParamBool:
+		_, ok = v.(bool)
+	case ParamList:
+		_, ok = v.([]interface{})
+	case ParamMap:
+		_, ok = v.(map[string]interface{})
+	case ParamDuration:
+		s, isString := v.(string)
+		if !isString {
+			ok = false
+		} else if _, err := time.ParseDuration(s); err != nil {
+			return fmt.Sprintf("must be a duration: %s", err)
+		}
+	}
+	if !ok {
+		return fmt.Sprintf("must be of type %s", p.Kind)
+	}
+	return ""
+}
+
+// inStrings reports if s is in list
+func inStrings(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,62 +1,331 @@
 package tasks
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-ping/ping"
 	"pkg.goda.sh/utils"
 )
 
-// Ping sends ICMP requests to a specific target host
+var (
+	// pingPrivileged remembers if raw ICMP sockets work: 0 unknown, 1 yes, 2 no
+	pingPrivileged int32
+)
+
+// pingUpdate is the Update of ping tasks, avg and jitt are whole milliseconds for the UI
+// while the other times are fractional milliseconds
+type pingUpdate struct {
+	Sent int       `json:"sent"`
+	Recv int       `json:"recv"`
+	Loss float64   `json:"loss"`
+	Avg  int       `json:"avg"`
+	Jitt int       `json:"jitt"`
+	Min  float64   `json:"min"`
+	Max  float64   `json:"max"`
+	P50  float64   `json:"p50"`
+	P90  float64   `json:"p90"`
+	P95  float64   `json:"p95"`
+	P99  float64   `json:"p99"`
+	Rtts []float64 `json:"rtts"`
+	Addr string    `json:"addr,omitempty"`
+}
+
+// Ping sends ICMP requests to a specific target host, raw sockets are used when permitted
+// and unprivileged UDP pings otherwise
 func Ping(args *TaskArgs) Result {
 	result := NewResult(args.Task)
 	params := utils.ParamsParser(args.Task.Params, utils.DefaultParams{
-		"count": 3,
-		"high":  75,
+		"count":    3,
+		"high":     75,
+		"network":  "ip",
+		"interval": "1s",
+		"size":     24,
+		"ttl":      64,
 	})
-	pinger, err := ping.NewPinger(params.Get("target").String())
-	if err != nil {
-		result.Error = err
+	if params.Get("protocol").String() == "tcp" {
+		return TCPPing(args)
+	}
+	target := params.Get("target").String()
+	if len(target) == 0 {
+		result.Fail(NewError(ClassConfig, "missing target"))
+		return result
+	}
+	if !validHost(target) {
+		result.Fail(NewError(ClassConfig, "invalid target %q, expected a host name or IP address", target))
+		return result
+	}
+	network := params.Get("network").String()
+	if network != "ip" && network != "ip4" && network != "ip6" {
+		result.Fail(NewError(ClassConfig, "invalid network %q, expected ip, ip4 or ip6", network))
+		return result
+	}
+	count := int(params.Get("count").Int64())
+	interval, err := time.ParseDuration(params.Get("interval").String())
+	if err != nil || interval <= 0 || count <= 0 {
+		result.Fail(NewError(ClassConfig, "invalid interval %q or count %d", params.Get("interval").String(), count))
+		return result
+	}
+	timeout := interval*time.Duration(count) + 5*time.Second
+	if t := params.Get("timeout").String(); len(t) > 0 {
+		if timeout, err = time.ParseDuration(t); err != nil {
+			result.Fail(NewError(ClassConfig, "invalid timeout: %s", err))
+			return result
+		}
+	}
+	if size := params.Get("size").Int64(); size < 24 {
+		result.Fail(NewError(ClassConfig, "size must be at least 24 bytes"))
+		return result
+	}
+	newPinger := func(privileged bool) (*ping.Pinger, error) {
+		pinger := ping.New(target)
+		pinger.SetNetwork(network)
+		if err := pinger.Resolve(); err != nil {
+			return nil, err
+		}
+		if err := TargetPolicy.Check(target, pinger.IPAddr().IP, -1); err != nil {
+			return nil, err
+		}
+		pinger.Count = count
+		pinger.Interval = interval
+		pinger.Timeout = timeout
+		pinger.Size = int(params.Get("size").Int64())
+		pinger.TTL = int(params.Get("ttl").Int64())
+		pinger.Source = params.Get("source").String()
+		pinger.SetPrivileged(privileged)
+		return pinger, nil
+	}
+	privileged, set := paramBool(args.Task.Params, "privileged")
+	if !set {
+		privileged = runtime.GOOS == "windows" || atomic.LoadInt32(&pingPrivileged) != 2
+	}
+	pinger, err := newPinger(privileged)
+	if err == nil {
+		err = pinger.Run() // Blocks until finished.
+		if !set && privileged && runtime.GOOS != "windows" {
+			if errors.Is(err, os.ErrPermission) {
+				// No CAP_NET_RAW, fall back to unprivileged pings from now on
+				atomic.StoreInt32(&pingPrivileged, 2)
+				if pinger, err = newPinger(false); err == nil {
+					err = pinger.Run()
+				}
+			} else if err == nil {
+				atomic.StoreInt32(&pingPrivileged, 1)
+			}
+		}
 	}
-	pinger.Count = int(params.Get("count").Int64())
-	pinger.SetPrivileged(true)
-	err = pinger.Run() // Blocks until finished.
 	if err != nil {
-		result.Error = err
-	}
-	if result.Error == nil {
-		pinged := pinger.Statistics()
-		avg := int(pinged.AvgRtt / time.Millisecond)
-		result.Warn = avg >= int(params.Get("high").Int64())
-		if pinged.PacketLoss > 0 {
-			result.Warn = true
+		result.Fail(err)
+		return result
+	}
+	stats := pinger.Statistics()
+	update := newPingUpdate(stats.PacketsSent, stats.Rtts)
+	update.Addr = stats.IPAddr.String()
+	pingResult(&result, update, int(params.Get("high").Int64()))
+	return result
+}
+
+// validHost reports if a target is an IP address or a syntactically valid host name, names
+// such as "300.1.1.1" or "https://example.org" can never resolve
+func validHost(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return true
+	}
+	labels := strings.Split(host, ".")
+	if len(host) == 0 || len(host) > 253 {
+		return false
+	}
+	if _, err := strconv.Atoi(labels[len(labels)-1]); err == nil {
+		return false // Top level domains are never numeric, this is a broken IP address
+	}
+	for _, l := range labels {
+		if len(l) == 0 || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return false
 		}
-		result.Spark = &Spark{
-			avg,
-			result.Warn,
+		for _, c := range l {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
 		}
-		if result.Warn {
-			result.Notification = fmt.Sprintf("ping of %dms detected with %f%% packet loss!", avg, pinged.PacketLoss)
+	}
+	return true
+}
+
+// TCPPing measures repeated TCP connect times to a host and port for targets that drop
+// ICMP, results have the same shape as Ping
+func TCPPing(args *TaskArgs) Result {
+	result := NewResult(args.Task)
+	params := utils.ParamsParser(args.Task.Params, utils.DefaultParams{
+		"count":    3,
+		"high":     75,
+		"port":     80,
+		"network":  "ip",
+		"interval": "1s",
+	})
+	target := params.Get("target").String()
+	if len(target) == 0 {
+		result.Fail(NewError(ClassConfig, "missing target"))
+		return result
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, strconv.FormatInt(params.Get("port").Int64(), 10))
+	}
+	host, port, _ := net.SplitHostPort(target)
+	if !validHost(host) {
+		result.Fail(NewError(ClassConfig, "invalid target %q, expected a host name or IP address", host))
+		return result
+	}
+	policyPort, err := net.LookupPort("tcp", port)
+	if err != nil {
+		result.Fail(NewError(ClassConfig, "invalid port %q: %s", port, err))
+		return result
+	}
+	network := params.Get("network").String()
+	if network != "ip" && network != "ip4" && network != "ip6" {
+		result.Fail(NewError(ClassConfig, "invalid network %q, expected ip, ip4 or ip6", network))
+		return result
+	}
+	count := int(params.Get("count").Int64())
+	interval, err := time.ParseDuration(params.Get("interval").String())
+	if err != nil || interval <= 0 || count <= 0 {
+		result.Fail(NewError(ClassConfig, "invalid interval %q or count %d", params.Get("interval").String(), count))
+		return result
+	}
+	timeout := interval*time.Duration(count) + 5*time.Second
+	if t := params.Get("timeout").String(); len(t) > 0 {
+		if timeout, err = time.ParseDuration(t); err != nil {
+			result.Fail(NewError(ClassConfig, "invalid timeout: %s", err))
+			return result
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// Resolve once so the times do not include DNS lookups and every attempt hits the same
+	// address, which is checked against the policy instead of each dial
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		result.Fail(err)
+		return result
+	}
+	if err := TargetPolicy.Check(host, ips[0], policyPort); err != nil {
+		result.Fail(err)
+		return result
+	}
+	addr := net.JoinHostPort(ips[0].String(), port)
+	dialer := &net.Dialer{}
+	rtts := []time.Duration{}
+	sent := 0
+	var lastErr error
+	for sent < count && ctx.Err() == nil {
+		if sent > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(interval):
+			}
+			if ctx.Err() != nil {
+				break
+			}
 		}
-		result.Update = struct {
-			Sent int     `json:"sent"`
-			Recv int     `json:"recv"`
-			Loss float64 `json:"loss"`
-			Avg  int     `json:"avg"`
-			Jitt int     `json:"jitt"`
-		}{
-			Sent: pinged.PacketsSent,
-			Recv: pinged.PacketsRecv,
-			Loss: pinged.PacketLoss,
-			Avg:  avg,
-			Jitt: int(pinged.StdDevRtt / time.Millisecond),
+		sent++
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			lastErr = err
+			continue
 		}
+		rtts = append(rtts, time.Since(start))
+		conn.Close()
+	}
+	update := newPingUpdate(sent, rtts)
+	update.Addr = ips[0].String()
+	pingResult(&result, update, int(params.Get("high").Int64()))
+	if len(rtts) == 0 && lastErr != nil {
+		result.Fail(lastErr)
 	}
 	return result
 }
 
+// newPingUpdate calculates ping statistics from the round trip times of received packets
+func newPingUpdate(sent int, rtts []time.Duration) pingUpdate {
+	update := pingUpdate{
+		Sent: sent,
+		Recv: len(rtts),
+		Rtts: make([]float64, len(rtts)),
+	}
+	if sent > 0 {
+		update.Loss = float64(sent-len(rtts)) / float64(sent) * 100
+	}
+	if len(rtts) == 0 {
+		return update
+	}
+	sorted := make([]time.Duration, len(rtts))
+	copy(sorted, rtts)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	var sum time.Duration
+	for i, rtt := range rtts {
+		update.Rtts[i] = millis64(rtt)
+		sum += rtt
+	}
+	avg := sum / time.Duration(len(rtts))
+	var variance float64
+	for _, rtt := range rtts {
+		variance += math.Pow(float64(rtt-avg), 2)
+	}
+	update.Avg = int(avg / time.Millisecond)
+	update.Jitt = int(time.Duration(math.Sqrt(variance/float64(len(rtts)))) / time.Millisecond)
+	update.Min = millis64(sorted[0])
+	update.Max = millis64(sorted[len(sorted)-1])
+	update.P50 = millis64(percentile(sorted, 50))
+	update.P90 = millis64(percentile(sorted, 90))
+	update.P95 = millis64(percentile(sorted, 95))
+	update.P99 = millis64(percentile(sorted, 99))
+	return update
+}
+
+// pingResult sets the warn state, notification, spark and update of a ping result
+func pingResult(result *Result, update pingUpdate, high int) {
+	result.Warn = update.Recv == 0 || update.Avg >= high || update.Loss > 0
+	result.Spark = &Spark{
+		update.Avg,
+		result.Warn,
+	}
+	if result.Warn {
+		result.Notification = fmt.Sprintf("ping of %dms detected with %f%% packet loss!", update.Avg, update.Loss)
+	}
+	result.Update = update
+}
+
+// percentile returns the nearest rank percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// millis64 converts a duration to fractional milliseconds rounded to microseconds
+func millis64(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
+
 // FakePing generates fake data for demo dashboards
 func FakePing(args *TaskArgs) Result {
 	result := NewResult(args.Task)
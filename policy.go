@@ -0,0 +1,249 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// TargetPolicy is enforced by every network runner when dialing targets
+	TargetPolicy = mustPolicy(PolicyRules{})
+	// defaultDenied are link-local and cloud metadata addresses, blocked unless
+	// PolicyRules.AllowLinkLocal is set
+	defaultDenied = []string{
+		"0.0.0.0/8",
+		"::/128",
+		"169.254.0.0/16",
+		"fe80::/10",
+		"100.100.100.200/32",
+		"fd00:ec2::254/128",
+		"metadata",
+		"metadata.google.internal",
+		"metadata.goog",
+		"instance-data",
+		"instance-data.ec2.internal",
+	}
+)
+
+// PolicyRules configures a Policy, Allow and Deny take CIDRs, IPs or host name globs
+// such as "*.example.org", ports take single ports or ranges such as "8000-8100"
+type PolicyRules struct {
+	Allow          []string
+	Deny           []string
+	AllowPorts     []string
+	DenyPorts      []string
+	AllowLinkLocal bool // Skip the default link-local and metadata denies
+}
+
+// Policy decides which targets network runners may connect to, denies always win and
+// when any allow rule is set a target must match one of them
+type Policy struct {
+	allowNets  []*net.IPNet
+	denyNets   []*net.IPNet
+	allowHosts []string
+	denyHosts  []string
+	allowPorts [][2]int
+	denyPorts  [][2]int
+}
+
+// NewPolicy compiles policy rules
+func NewPolicy(rules PolicyRules) (*Policy, error) {
+	p := &Policy{}
+	deny := rules.Deny
+	if !rules.AllowLinkLocal {
+		deny = append(append([]string{}, defaultDenied...), deny...)
+	}
+	var err error
+	if p.allowNets, p.allowHosts, err = parseTargets(rules.Allow); err != nil {
+		return nil, err
+	}
+	if p.denyNets, p.denyHosts, err = parseTargets(deny); err != nil {
+		return nil, err
+	}
+	if p.allowPorts, err = parsePorts(rules.AllowPorts); err != nil {
+		return nil, err
+	}
+	if p.denyPorts, err = parsePorts(rules.DenyPorts); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// mustPolicy compiles policy rules that are known to be valid
+func mustPolicy(rules PolicyRules) *Policy {
+	p, err := NewPolicy(rules)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// CheckHost checks a host name and port before it is resolved, allowed reports if the
+// host matched an allow rule so its addresses skip the CIDR allowlist, port rules are
+// skipped when port is negative, e.g. for ICMP
+func (p *Policy) CheckHost(host string, port int) (allowed bool, err error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, g := range p.denyHosts {
+		if ok, _ := path.Match(g, host); ok {
+			return false, blocked(host)
+		}
+	}
+	if port >= 0 && (inPorts(p.denyPorts, port) || (len(p.allowPorts) > 0 && !inPorts(p.allowPorts, port))) {
+		return false, blocked(net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	for _, g := range p.allowHosts {
+		if ok, _ := path.Match(g, host); ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CheckIP checks a resolved address, hostAllowed is the result of CheckHost. Addresses
+// that could not be parsed are blocked as they cannot be matched against the deny list
+func (p *Policy) CheckIP(ip net.IP, hostAllowed bool) error {
+	if ip == nil {
+		return blocked("with an invalid address")
+	}
+	for _, n := range p.denyNets {
+		if n.Contains(ip) {
+			return blocked(ip.String())
+		}
+	}
+	if hostAllowed || (len(p.allowNets) == 0 && len(p.allowHosts) == 0) {
+		return nil
+	}
+	for _, n := range p.allowNets {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	return blocked(ip.String())
+}
+
+// Check checks a host and the address it resolved to
+func (p *Policy) Check(host string, ip net.IP, port int) error {
+	allowed, err := p.CheckHost(host, port)
+	if err != nil {
+		return err
+	}
+	return p.CheckIP(ip, allowed)
+}
+
+// DialContext connects to an address once the host and every resolved address it dials
+// pass the policy, addresses are checked at dial time after DNS resolution
+func (p *Policy) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return p.dialer(network, address, 0, func(d *net.Dialer) (net.Conn, error) {
+		return d.DialContext(ctx, network, address)
+	})
+}
+
+// Dial connects to an address like net.DialTimeout once it passes the policy
+func (p *Policy) Dial(network string, address string, timeout time.Duration) (net.Conn, error) {
+	return p.dialer(network, address, timeout, func(d *net.Dialer) (net.Conn, error) {
+		return d.Dial(network, address)
+	})
+}
+
+// dialer checks the host and calls dial with a dialer that checks resolved addresses
+func (p *Policy) dialer(network string, address string, timeout time.Duration, dial func(*net.Dialer) (net.Conn, error)) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, NewError(ClassConfig, "invalid target %q: %s", address, err)
+	}
+	port, err := net.LookupPort(network, portStr)
+	if err != nil {
+		return nil, NewError(ClassConfig, "invalid port %q: %s", portStr, err)
+	}
+	allowed, err := p.CheckHost(host, port)
+	if err != nil {
+		return nil, err
+	}
+	return dial(&net.Dialer{
+		Timeout: timeout,
+		Control: func(_ string, resolved string, _ syscall.RawConn) error {
+			ipStr, _, err := net.SplitHostPort(resolved)
+			if err != nil {
+				return err
+			}
+			if i := strings.IndexByte(ipStr, '%'); i >= 0 {
+				ipStr = ipStr[:i] // Zoned IPv6 such as fe80::1%eth0 is checked without its zone
+			}
+			return p.CheckIP(net.ParseIP(ipStr), allowed)
+		},
+	})
+}
+
+// blocked is the error for targets the policy does not allow, it does not cancel the task
+// as the target may resolve to an allowed address on a later run
+func blocked(target string) error {
+	return NewError(ClassPolicy, "target %s is blocked by policy", target)
+}
+
+// parseTargets splits rules into networks and lower case host globs
+func parseTargets(rules []string) ([]*net.IPNet, []string, error) {
+	nets := []*net.IPNet{}
+	hosts := []string{}
+	for _, r := range rules {
+		r = strings.TrimSpace(r)
+		if _, n, err := net.ParseCIDR(r); err == nil {
+			nets = append(nets, n)
+		} else if ip := net.ParseIP(r); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else if _, err := path.Match(r, ""); err == nil && len(r) > 0 {
+			hosts = append(hosts, strings.ToLower(r))
+		} else {
+			return nil, nil, fmt.Errorf("invalid policy rule %q", r)
+		}
+	}
+	return nets, hosts, nil
+}
+
+// parsePorts parses single ports and port ranges
+func parsePorts(rules []string) ([][2]int, error) {
+	ports := [][2]int{}
+	for _, r := range rules {
+		low, high, err := parsePortRange(r)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, [2]int{low, high})
+	}
+	return ports, nil
+}
+
+// parsePortRange parses "443" or "8000-8100"
+func parsePortRange(r string) (int, int, error) {
+	parts := strings.SplitN(strings.TrimSpace(r), "-", 2)
+	low, err := strconv.Atoi(parts[0])
+	if err != nil || low < 0 || low > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", r)
+	}
+	high := low
+	if len(parts) == 2 {
+		if high, err = strconv.Atoi(parts[1]); err != nil || high < low || high > 65535 {
+			return 0, 0, fmt.Errorf("invalid port range %q", r)
+		}
+	}
+	return low, high, nil
+}
+
+// inPorts reports if a port is within any of the ranges
+func inPorts(ranges [][2]int, port int) bool {
+	for _, r := range ranges {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
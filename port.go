@@ -1,42 +1,363 @@
 package tasks
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"pkg.goda.sh/utils"
 )
 
-// Port checks if a port is open on a target host
+var (
+	// maxPortChecks limits how many ports a single port task can check
+	maxPortChecks = 1024
+)
+
+// Port checks if a port is open on a target host. A "send" payload is written once
+// connected and the reply is read when "expect" is set or "banner" is true, e.g. to read an
+// SSH banner or to send a Redis PING and expect +PONG. UDP ports only count as open when
+// they reply, an ICMP port unreachable marks them closed. Setting "state" to closed asserts
+// that the port is not reachable instead. A "targets" list checks many hosts and port
+// ranges concurrently and returns a table with a row per port
 func Port(args *TaskArgs) Result {
 	result := NewResult(args.Task)
 	params := utils.ParamsParser(args.Task.Params, utils.DefaultParams{
-		"method":  "tcp",
-		"timeout": 10,
+		"method":      "tcp",
+		"timeout":     10,
+		"state":       "open",
+		"concurrency": 10,
 	})
-	method := params.Get("method").String()
+	probe := portProbe{
+		method:  params.Get("method").String(),
+		timeout: time.Duration(params.Get("timeout").Int64()) * time.Second,
+		send:    params.Get("send").String(),
+	}
+	probe.banner, _ = paramBool(args.Task.Params, "banner")
 	target := params.Get("target").String()
-	timeout := params.Get("timeout").Int64()
-	conn, err := net.DialTimeout(method, target, time.Duration(timeout)*time.Second)
-	if err != nil {
-		result.Error = err
-	} else if conn != nil {
-		conn.Close()
+	state := params.Get("state").String()
+	_, multi := args.Task.Params["targets"]
+	if len(target) == 0 && !multi {
+		result.Fail(NewError(ClassConfig, "missing target"))
+		return result
+	}
+	if state != "open" && state != "closed" {
+		result.Fail(NewError(ClassConfig, "invalid state %q, expected open or closed", state))
+		return result
+	}
+	if expect := params.Get("expect").String(); len(expect) > 0 {
+		var err error
+		if probe.matcher, err = regexp.Compile(expect); err != nil {
+			result.Fail(NewError(ClassConfig, "invalid expect regex: %s", err))
+			return result
+		}
+	}
+	if strings.Contains(probe.send, "\\") {
+		if unquoted, err := strconv.Unquote(`"` + strings.ReplaceAll(probe.send, `"`, `\"`) + `"`); err == nil {
+			probe.send = unquoted // Allow escapes such as \r\n in single quoted YAML
+		}
 	}
-	result.Warn = conn == nil || result.Error != nil
+	if multi {
+		return portTable(args, result, probe, state, int(params.Get("concurrency").Int64()))
+	}
+	c := probe.check(target, probe.method, state)
+	if !c.OK {
+		if c.err != nil && state == "open" {
+			result.Fail(c.err)
+		} else {
+			result.Notification = fmt.Sprintf("Port checker found %s %s, expected %s!", target, c.State, state)
+		}
+	}
+	result.Warn = !c.OK
+	result.Update = struct {
+		Connected bool    `json:"connected"`
+		State     string  `json:"state"`
+		Banner    string  `json:"banner,omitempty"`
+		Time      float64 `json:"time"`
+	}{
+		Connected: c.State == "open",
+		State:     c.State,
+		Banner:    c.Banner,
+		Time:      c.Time,
+	}
+	return result
+}
+
+// portTable checks every target of the "targets" param with bounded concurrency. Targets
+// are "host:port", "host:low-high" or a host using the "ports" param, or maps with their
+// own "target", "ports", "method" and "state"
+func portTable(args *TaskArgs, result Result, probe portProbe, state string, concurrency int) Result {
+	entries, ok := args.Task.Params["targets"].([]interface{})
+	if !ok || len(entries) == 0 {
+		result.Fail(NewError(ClassConfig, "targets must be a list of targets"))
+		return result
+	}
+	ports := paramList(args.Task.Params["ports"])
+	checks := []portCheck{}
+	for _, e := range entries {
+		entry := map[string]interface{}{"target": e}
+		if m, ok := e.(map[string]interface{}); ok {
+			entry = m
+		}
+		target, _ := entry["target"].(string)
+		method, _ := entry["method"].(string)
+		expect, _ := entry["state"].(string)
+		if len(method) == 0 {
+			method = probe.method
+		}
+		if len(expect) == 0 {
+			expect = state
+		}
+		if expect != "open" && expect != "closed" {
+			result.Fail(NewError(ClassConfig, "invalid state %q for target %q, expected open or closed", expect, target))
+			return result
+		}
+		entryPorts := ports
+		if p, ok := entry["ports"]; ok {
+			entryPorts = paramList(p)
+		}
+		addrs, err := expandPorts(target, entryPorts)
+		if err != nil {
+			result.Fail(NewError(ClassConfig, "%s", err))
+			return result
+		}
+		for _, addr := range addrs {
+			checks = append(checks, portCheck{Target: addr, Method: method, Expect: expect})
+		}
+		if len(checks) > maxPortChecks {
+			result.Fail(NewError(ClassConfig, "too many ports, at most %d can be checked per task", maxPortChecks))
+			return result
+		}
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c *portCheck) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			*c = probe.check(c.Target, c.Method, c.Expect)
+		}(&checks[i])
+	}
+	wg.Wait()
+	failed := []string{}
+	for _, c := range checks {
+		if !c.OK {
+			failed = append(failed, fmt.Sprintf("%s/%s is %s, expected %s", c.Target, c.Method, c.State, c.Expect))
+		}
+	}
+	result.Warn = len(failed) > 0
 	if result.Warn {
-		result.Notification = fmt.Sprintf("Port checker could not connect to %s target within %d seconds!", method, timeout)
+		count := len(failed)
+		if count > 5 {
+			failed = append(failed[:5], fmt.Sprintf("%d more", count-5))
+		}
+		result.Notification = fmt.Sprintf("Port checker found %d of %d ports in the wrong state: %s!", count, len(checks), strings.Join(failed, ", "))
 	}
 	result.Update = struct {
-		Connected bool `json:"connected"`
+		Connected bool        `json:"connected"`
+		Passed    int         `json:"passed"`
+		Failed    int         `json:"failed"`
+		Checks    []portCheck `json:"checks"`
 	}{
 		Connected: !result.Warn,
+		Passed:    len(checks) - len(failed),
+		Failed:    len(failed),
+		Checks:    checks,
 	}
 	return result
 }
 
+// portProbe is how ports are checked
+type portProbe struct {
+	method  string
+	timeout time.Duration
+	send    string
+	matcher *regexp.Regexp
+	banner  bool
+}
+
+// portCheck is the result of checking a single port, times are in milliseconds
+type portCheck struct {
+	Target string  `json:"target"`
+	Method string  `json:"method"`
+	Expect string  `json:"expect"`
+	State  string  `json:"state"`
+	Banner string  `json:"banner,omitempty"`
+	Time   float64 `json:"time"`
+	OK     bool    `json:"ok"`
+	Error  string  `json:"error,omitempty"`
+	err    error
+}
+
+// check connects to a target and runs the probe. The state is open, closed, filtered when
+// the connection timed out, open|filtered when a UDP port did not reply, which fails the
+// check as a dropped probe looks the same, or error when the target could not be checked
+// at all. A zero timeout means no timeout, except for UDP where it is required to tell
+// when to give up on a reply
+func (p portProbe) check(target string, method string, expect string) portCheck {
+	c := portCheck{Target: target, Method: method, Expect: expect, State: "open"}
+	udp := strings.HasPrefix(method, "udp")
+	if udp && p.timeout <= 0 {
+		c.State = "error"
+		c.err = NewError(ClassConfig, "a timeout is required for %s checks of %s", method, target)
+		c.Error = c.err.Error()
+		return c
+	}
+	var response []byte
+	start := time.Now()
+	conn, err := TargetPolicy.Dial(method, target, p.timeout)
+	if err == nil && conn != nil {
+		defer conn.Close()
+		if p.timeout > 0 {
+			conn.SetDeadline(start.Add(p.timeout))
+		}
+		if len(p.send) > 0 || udp {
+			_, err = conn.Write([]byte(p.send))
+		}
+		if err == nil && (udp || p.matcher != nil || p.banner) {
+			response, err = readResponse(conn, p.matcher, udp)
+		}
+		var netErr net.Error
+		switch {
+		case udp && errors.Is(err, syscall.ECONNREFUSED):
+			c.State = "closed"
+		case udp && errors.As(err, &netErr) && netErr.Timeout() && len(response) == 0:
+			c.State = "open|filtered" // No reply, the port is open or the probe was dropped
+			err = NewError(ClassTimeout, "no response from %s within %s", target, p.timeout)
+		case len(response) > 0:
+			err = nil
+		}
+		if err == nil && p.matcher != nil && !p.matcher.Match(response) {
+			err = NewError(ClassParse, "response from %s does not match %q", target, p.matcher.String())
+		}
+	} else if err != nil {
+		switch ClassifyError(err).Class {
+		case ClassTimeout:
+			c.State = "filtered"
+		case ClassConfig, ClassDNS, ClassPermission:
+			c.State = "error"
+		default:
+			c.State = "closed"
+		}
+	} else {
+		c.State = "closed"
+	}
+	c.Time = millis64(time.Since(start))
+	c.Banner = bannerLine(response)
+	if err != nil {
+		c.err = ClassifyError(err)
+		c.Error = c.err.Error()
+	}
+	if expect == "closed" {
+		c.OK = c.State == "closed" || c.State == "filtered"
+		if c.OK {
+			c.Error = "" // The failed connection is the expected outcome
+		}
+	} else {
+		c.OK = c.err == nil && c.State != "closed"
+	}
+	return c
+}
+
+// expandPorts returns the host:port addresses of a target with an optional port or port
+// range, targets without a port use the given ports
+func expandPorts(target string, ports []string) ([]string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host = strings.Trim(target, "[]")
+	} else {
+		ports = []string{port}
+	}
+	if len(host) == 0 {
+		return nil, fmt.Errorf("missing target")
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("missing port for target %q", target)
+	}
+	addrs := []string{}
+	for _, r := range ports {
+		low, high, err := parsePortRange(r)
+		if err != nil {
+			return nil, err
+		}
+		for port := low; port <= high && len(addrs) <= maxPortChecks; port++ {
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	}
+	return addrs, nil
+}
+
+// paramList reads a raw list param as strings, a single value is a list of one
+func paramList(v interface{}) []string {
+	list := []string{}
+	switch v := v.(type) {
+	case nil:
+	case []interface{}:
+		for _, i := range v {
+			list = append(list, fmt.Sprint(i))
+		}
+	case []string:
+		list = append(list, v...)
+	default:
+		list = append(list, fmt.Sprint(v))
+	}
+	return list
+}
+
+// readResponse reads the reply to a probe. UDP replies are a single datagram, TCP replies
+// are read until the matcher matches, the first line is complete without a matcher, the
+// connection is closed or 4KB have been read
+func readResponse(conn net.Conn, matcher *regexp.Regexp, udp bool) ([]byte, error) {
+	buf := make([]byte, 65535)
+	if udp {
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+	response := []byte{}
+	for len(response) < 4096 {
+		n, err := conn.Read(buf[:4096-len(response)])
+		response = append(response, buf[:n]...)
+		if matcher != nil && matcher.Match(response) || matcher == nil && bytes.IndexByte(response, '\n') >= 0 {
+			return response, nil
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return response, err
+		}
+	}
+	return response, nil
+}
+
+// bannerLine returns the first line of a response for display
+func bannerLine(response []byte) string {
+	line := string(response)
+	if i := strings.IndexAny(line, "\r\n"); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.ToValidUTF8(strings.TrimSpace(line), "")
+	if len(line) > 256 {
+		line = line[:256]
+	}
+	return line
+}
+
 // FakePort generates a fake port result for demo dashboards
 func FakePort(args *TaskArgs) Result {
 	result := NewResult(args.Task)
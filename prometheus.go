@@ -0,0 +1,302 @@
+package tasks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"pkg.goda.sh/utils"
+)
+
+// sample is a single series value from a metrics exposition
+type sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// matcher is a label matcher of a series selector
+type matcher struct {
+	Label string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+// selector picks series by metric name and label matchers, e.g. http_requests_total{code=~"5.."}
+type selector struct {
+	Metric   string
+	Matchers []matcher
+}
+
+// Prometheus scrapes a Prometheus or OpenMetrics endpoint and aggregates the selected series
+func Prometheus(args *TaskArgs) Result {
+	result := NewResult(args.Task)
+	params := utils.ParamsParser(args.Task.Params, utils.DefaultParams{
+		"aggregate": "sum",
+	})
+	sel, err := parseSelector(params.Get("query").String())
+	if err != nil {
+		result.Fail(NewError(ClassConfig, "%s", err))
+		return result
+	}
+	req, client := CreateAuthRequest("GET", params.Get("url").String(), nil, args.Task.Params)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Fail(err)
+	} else {
+		defer resp.Body.Close()
+		if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) { // Error pages are not expositions
+			result.Fail(StatusError(resp.StatusCode))
+			result.Warn = true
+			return result
+		}
+		samples, err := parseExposition(resp.Body)
+		if err != nil {
+			result.Fail(NewError(ClassParse, "%s", err))
+		} else {
+			values := []float64{}
+			for _, s := range samples {
+				if sel.matches(s) {
+					values = append(values, s.Value)
+				}
+			}
+			aggregate := params.Get("aggregate").String()
+			value, err := aggregateValues(aggregate, values)
+			if err != nil {
+				result.Fail(NewError(ClassConfig, "%s", err))
+				return result
+			}
+			empty := len(values) == 0
+			high, hasHigh := paramFloat(args.Task.Params, "high")
+			low, hasLow := paramFloat(args.Task.Params, "low")
+			result.Warn = empty || !finite(value) || (hasHigh && value >= high) || (hasLow && value <= low)
+			if result.Warn {
+				if empty {
+					result.Fail(NewError(ClassParse, "no series matched %q!", params.Get("query").String()))
+				} else if !finite(value) {
+					result.Fail(NewError(ClassParse, "%s of %q is %s, not a finite number!", aggregate, params.Get("query").String(), formatFloat(value)))
+				} else {
+					result.Notification = fmt.Sprintf("%s of %q is %s, outside of the allowed range!", aggregate, params.Get("query").String(), formatFloat(value))
+				}
+			}
+			if !empty && finite(value) { // NaN and Inf cannot be encoded as JSON
+				result.Spark = &Spark{
+					value,
+					result.Warn,
+				}
+			}
+			result.Update = struct {
+				Content string `json:"content"`
+				Series  int    `json:"series"`
+			}{
+				Content: formatFloat(value),
+				Series:  len(values),
+			}
+		}
+	}
+	return result
+}
+
+// aggregateValues reduces series values with sum, avg, min, max or count
+func aggregateValues(aggregate string, values []float64) (float64, error) {
+	if aggregate == "count" {
+		return float64(len(values)), nil
+	}
+	if len(values) == 0 {
+		return 0, nil
+	}
+	value := values[0]
+	switch aggregate {
+	case "sum", "avg":
+		for _, v := range values[1:] {
+			value += v
+		}
+		if aggregate == "avg" {
+			value /= float64(len(values))
+		}
+	case "min":
+		for _, v := range values[1:] {
+			value = math.Min(value, v)
+		}
+	case "max":
+		for _, v := range values[1:] {
+			value = math.Max(value, v)
+		}
+	default:
+		return 0, fmt.Errorf("unknown aggregate %q", aggregate)
+	}
+	return value, nil
+}
+
+// finite reports if a value is neither NaN nor infinite
+func finite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// formatFloat prints a metric value without trailing zeros
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// parseSelector parses a series selector such as up{job="api",instance=~"web-.*"}
+func parseSelector(s string) (selector, error) {
+	s = strings.TrimSpace(s)
+	sel := selector{}
+	i := strings.IndexByte(s, '{')
+	if i < 0 {
+		sel.Metric = s
+	} else {
+		sel.Metric = strings.TrimSpace(s[:i])
+		if !strings.HasSuffix(s, "}") {
+			return sel, fmt.Errorf("invalid selector %q: missing closing brace", s)
+		}
+		rest := s[i+1 : len(s)-1]
+		for len(strings.TrimSpace(rest)) > 0 {
+			rest = strings.TrimLeft(rest, " ,")
+			j := strings.IndexAny(rest, "=!")
+			if j <= 0 {
+				return sel, fmt.Errorf("invalid selector %q: expected a label matcher", s)
+			}
+			m := matcher{Label: strings.TrimSpace(rest[:j])}
+			rest = rest[j:]
+			for _, op := range []string{"=~", "!~", "!=", "="} {
+				if strings.HasPrefix(rest, op) {
+					m.Op = op
+					break
+				}
+			}
+			if len(m.Op) == 0 {
+				return sel, fmt.Errorf("invalid selector %q: unknown operator", s)
+			}
+			value, remaining, err := readQuoted(strings.TrimSpace(rest[len(m.Op):]))
+			if err != nil {
+				return sel, fmt.Errorf("invalid selector %q: %w", s, err)
+			}
+			m.Value, rest = value, remaining
+			if m.Op == "=~" || m.Op == "!~" {
+				if m.re, err = regexp.Compile("^(?:" + m.Value + ")$"); err != nil {
+					return sel, fmt.Errorf("invalid selector %q: %w", s, err)
+				}
+			}
+			sel.Matchers = append(sel.Matchers, m)
+		}
+	}
+	if len(sel.Metric) == 0 && len(sel.Matchers) == 0 {
+		return sel, fmt.Errorf("missing query")
+	}
+	return sel, nil
+}
+
+// matches reports if a sample is picked by the selector
+func (sel selector) matches(s sample) bool {
+	if len(sel.Metric) > 0 && s.Name != sel.Metric {
+		return false
+	}
+	for _, m := range sel.Matchers {
+		v := s.Labels[m.Label]
+		if m.Label == "__name__" {
+			v = s.Name
+		}
+		switch m.Op {
+		case "=":
+			if v != m.Value {
+				return false
+			}
+		case "!=":
+			if v == m.Value {
+				return false
+			}
+		case "=~":
+			if !m.re.MatchString(v) {
+				return false
+			}
+		case "!~":
+			if m.re.MatchString(v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseExposition reads samples from the Prometheus text or OpenMetrics format
+func parseExposition(r io.Reader) ([]sample, error) {
+	samples := []sample{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		s := sample{Labels: map[string]string{}}
+		i := strings.IndexAny(line, "{ \t")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid metric on line %d", n)
+		}
+		s.Name, line = line[:i], line[i:]
+		if line[0] == '{' {
+			line = line[1:]
+			for {
+				line = strings.TrimLeft(line, " ,")
+				if strings.HasPrefix(line, "}") {
+					line = line[1:]
+					break
+				}
+				j := strings.IndexByte(line, '=')
+				if j <= 0 {
+					return nil, fmt.Errorf("invalid labels on line %d", n)
+				}
+				name := strings.TrimSpace(line[:j])
+				value, rest, err := readQuoted(strings.TrimSpace(line[j+1:]))
+				if err != nil {
+					return nil, fmt.Errorf("invalid labels on line %d: %w", n, err)
+				}
+				s.Labels[name], line = value, rest
+			}
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("missing value on line %d", n)
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value on line %d: %w", n, err)
+		}
+		s.Value = value
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
+
+// readQuoted reads a double quoted, backslash escaped string and returns the rest of the input
+func readQuoted(s string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", s, fmt.Errorf("expected a quoted value")
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				if s[i] == 'n' {
+					b.WriteByte('\n')
+				} else {
+					b.WriteByte(s[i])
+				}
+			}
+		case '"':
+			return b.String(), s[i+1:], nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated quoted value")
+}
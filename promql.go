@@ -0,0 +1,155 @@
+package tasks
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"pkg.goda.sh/utils"
+)
+
+// row is a single series of a PromQL result
+type row struct {
+	Labels string `json:"labels"`
+	Value  string `json:"value"`
+}
+
+// PromQL runs an instant or range query against a Prometheus compatible HTTP API
+func PromQL(args *TaskArgs) Result {
+	result := NewResult(args.Task)
+	params := utils.ParamsParser(args.Task.Params, utils.DefaultParams{
+		"type":  "instant",
+		"range": "1h",
+		"step":  "1m",
+		"limit": 10,
+	})
+	query := url.Values{}
+	query.Set("query", params.Get("query").String())
+	endpoint := "query"
+	if params.Get("type").String() == "range" {
+		window, err := time.ParseDuration(params.Get("range").String())
+		if err != nil {
+			result.Fail(NewError(ClassConfig, "invalid range: %s", err))
+			return result
+		}
+		now := time.Now()
+		endpoint = "query_range"
+		query.Set("start", strconv.FormatInt(now.Add(-window).Unix(), 10))
+		query.Set("end", strconv.FormatInt(now.Unix(), 10))
+		query.Set("step", params.Get("step").String())
+	}
+	req, client := CreateAuthRequest("GET", fmt.Sprintf("%s/api/v1/%s?%s", strings.TrimSuffix(params.Get("url").String(), "/"), endpoint, query.Encode()), nil, args.Task.Params)
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Fail(err)
+	} else {
+		defer resp.Body.Close()
+		contents, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			result.Fail(err)
+		} else {
+			body := string(contents)
+			if status := gjson.Get(body, "status").String(); status != "success" {
+				result.Warn = true
+				switch {
+				case gjson.Get(body, "errorType").String() == "bad_data":
+					// Not a config error, bad_data also covers server limits such as too many points
+					result.Fail(NewError(ClassProtocol, "query rejected: %s", gjson.Get(body, "error").String()))
+				case !(resp.StatusCode >= 200 && resp.StatusCode <= 299):
+					result.Fail(StatusError(resp.StatusCode))
+				default:
+					result.Fail(NewError(ClassParse, "query failed: %s", gjson.Get(body, "error").String()))
+				}
+				return result
+			}
+			rows, values := promRows(gjson.Get(body, "data"))
+			high, hasHigh := paramFloat(args.Task.Params, "high")
+			low, hasLow := paramFloat(args.Task.Params, "low")
+			breached := []string{}
+			for i, v := range values {
+				if (hasHigh && v >= high) || (hasLow && v <= low) {
+					breached = append(breached, fmt.Sprintf("%s %s", rows[i].Labels, rows[i].Value))
+				}
+			}
+			result.Warn = len(rows) == 0 || len(breached) > 0 || !finite(values[0])
+			if result.Warn {
+				if len(rows) == 0 {
+					result.Fail(NewError(ClassParse, "no value returned by PromQL query!"))
+				} else if !finite(values[0]) {
+					result.Fail(NewError(ClassParse, "PromQL value %s %s is not a finite number!", rows[0].Labels, rows[0].Value))
+				} else {
+					result.Notification = fmt.Sprintf("PromQL value outside of the allowed range: %s", strings.Join(breached, ", "))
+				}
+			}
+			content := ""
+			if len(rows) > 0 {
+				content = rows[0].Value
+			}
+			if len(rows) > 0 && finite(values[0]) { // NaN and Inf cannot be encoded as JSON
+				result.Spark = &Spark{
+					values[0],
+					result.Warn,
+				}
+			}
+			if limit := int(params.Get("limit").Int64()); limit > 0 && len(rows) > limit {
+				rows = rows[:limit]
+			}
+			result.Update = struct {
+				Content string `json:"content"`
+				Type    string `json:"type"`
+				Rows    []row  `json:"rows,omitempty"`
+			}{
+				Content: content,
+				Type:    gjson.Get(body, "data.resultType").String(),
+				Rows:    rows,
+			}
+		}
+	}
+	return result
+}
+
+// promRows converts vector, matrix, scalar and string results into rows, matrix series
+// use their newest value, values holds the parsed number of each row
+func promRows(data gjson.Result) ([]row, []float64) {
+	rows := []row{}
+	values := []float64{}
+	add := func(labels string, sample gjson.Result) {
+		v := sample.Get("1").String()
+		rows = append(rows, row{Labels: labels, Value: v})
+		f, _ := strconv.ParseFloat(v, 64)
+		values = append(values, f)
+	}
+	switch data.Get("resultType").String() {
+	case "scalar", "string":
+		add("", data.Get("result"))
+	case "vector":
+		for _, s := range data.Get("result").Array() {
+			add(promLabels(s.Get("metric")), s.Get("value"))
+		}
+	case "matrix":
+		for _, s := range data.Get("result").Array() {
+			if samples := s.Get("values").Array(); len(samples) > 0 {
+				add(promLabels(s.Get("metric")), samples[len(samples)-1])
+			}
+		}
+	}
+	return rows, values
+}
+
+// promLabels formats a metric label set as name{label="value",...}
+func promLabels(metric gjson.Result) string {
+	labels := []string{}
+	metric.ForEach(func(k, v gjson.Result) bool {
+		if k.String() != "__name__" {
+			labels = append(labels, fmt.Sprintf("%s=%q", k.String(), v.String()))
+		}
+		return true
+	})
+	sort.Strings(labels)
+	return fmt.Sprintf("%s{%s}", metric.Get("__name__").String(), strings.Join(labels, ","))
+}
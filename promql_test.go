@@ -0,0 +1,142 @@
+package tasks
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// promAPI starts a local stand-in for the Prometheus HTTP API that requires either basic
+// auth as monitor:hunter2 or the bearer token "token"
+func promAPI(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, basic := r.BasicAuth()
+		if r.Header.Get("Authorization") != "Bearer token" && !(basic && user == "monitor" && password == "hunter2") {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"status":"error","errorType":"unauthorized","error":"unauthorized"}`)
+			return
+		}
+		query := r.URL.Query().Get("query")
+		switch {
+		case r.URL.Path == "/api/v1/query_range":
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"api"},"values":[[1,"1"],[2,"0.5"]]}]}}`)
+		case r.URL.Path != "/api/v1/query":
+			http.NotFound(w, r)
+		case query == "scalar(up)":
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"scalar","result":[1,"2"]}}`)
+		case query == "up":
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"api"},"value":[1,"1"]},{"metric":{"__name__":"up","job":"db"},"value":[1,"0"]}]}}`)
+		case query == "absent":
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"parse error: unexpected end of input"}`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestPromQL(t *testing.T) {
+	url := promAPI(t)
+	tests := []struct {
+		name    string
+		params  map[string]interface{}
+		warn    bool
+		class   ErrorClass
+		kind    string
+		content string
+		rows    int64
+	}{
+		{
+			name:    "vector with bearer auth",
+			params:  map[string]interface{}{"query": "up", "bearer": "token"},
+			kind:    "vector",
+			content: "1",
+			rows:    2,
+		},
+		{
+			name:    "vector with basic auth",
+			params:  map[string]interface{}{"query": "up", "username": "monitor", "password": "hunter2"},
+			kind:    "vector",
+			content: "1",
+			rows:    2,
+		},
+		{
+			name:    "vector below the low threshold",
+			params:  map[string]interface{}{"query": "up", "bearer": "token", "low": 0},
+			warn:    true,
+			kind:    "vector",
+			content: "1",
+			rows:    2,
+		},
+		{
+			name:    "scalar",
+			params:  map[string]interface{}{"query": "scalar(up)", "bearer": "token", "high": 5},
+			kind:    "scalar",
+			content: "2",
+			rows:    1,
+		},
+		{
+			name:    "range query uses the newest sample",
+			params:  map[string]interface{}{"query": "up", "type": "range", "bearer": "token"},
+			kind:    "matrix",
+			content: "0.5",
+			rows:    1,
+		},
+		{
+			name:   "empty result",
+			params: map[string]interface{}{"query": "absent", "bearer": "token"},
+			warn:   true,
+			class:  ClassParse,
+			kind:   "vector",
+		},
+		{
+			name:   "bad_data",
+			params: map[string]interface{}{"query": "up{", "bearer": "token"},
+			warn:   true,
+			class:  ClassProtocol,
+		},
+		{
+			name:   "wrong password",
+			params: map[string]interface{}{"query": "up", "username": "monitor", "password": "wrong"},
+			warn:   true,
+			class:  ClassHTTPStatus,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.params["url"] = url + "/"
+			cancelled := false
+			result := Run(&TaskArgs{Task: Task{ID: "promql", Task: "promql", Params: tt.params, Cancel: func() bool {
+				cancelled = true
+				return true
+			}}})
+			if cancelled {
+				t.Fatal("task was cancelled")
+			}
+			if result.Warn != tt.warn {
+				t.Fatalf("warn = %t, want %t: %s", result.Warn, tt.warn, result.Notification)
+			}
+			if te := ClassifyError(result.Error); tt.class == "" && te != nil {
+				t.Fatalf("unexpected error %s", te)
+			} else if tt.class != "" && (te == nil || te.Class != tt.class) {
+				t.Fatalf("error = %v, want class %s", result.Error, tt.class)
+			}
+			if tt.class == ClassProtocol || tt.class == ClassHTTPStatus {
+				return
+			}
+			if got := lastUpdate(result.Update, "type").String(); got != tt.kind {
+				t.Errorf("type = %q, want %q", got, tt.kind)
+			}
+			if got := lastUpdate(result.Update, "content").String(); got != tt.content {
+				t.Errorf("content = %q, want %q", got, tt.content)
+			}
+			if got := lastUpdate(result.Update, "rows.#").Int(); got != tt.rows {
+				t.Errorf("rows = %d, want %d", got, tt.rows)
+			}
+		})
+	}
+}
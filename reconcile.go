@@ -0,0 +1,235 @@
+package tasks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reconciled lists the task IDs touched by Reconcile
+type Reconciled struct {
+	Added     []string `json:"added,omitempty"`
+	Removed   []string `json:"removed,omitempty"`
+	Changed   []string `json:"changed,omitempty"`
+	Unchanged []string `json:"unchanged,omitempty"`
+}
+
+// TaskHash returns the stable identity of a task from its Hash fields, it is used as the
+// ID of tasks that do not set one
+func TaskHash(task Task, machine string) string {
+	b, _ := json.Marshal(Hash{
+		Label:    task.Label,
+		Interval: task.Interval,
+		Task:     task.Task,
+		ID:       task.ID,
+		Once:     task.Once,
+		Machine:  machine,
+	})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Fingerprint hashes everything that defines how a task runs, tasks with the same ID but
+// a different fingerprint are restarted by Reconcile
+func Fingerprint(task Task) string {
+	b, _ := json.Marshal(struct {
+		Hash
+		Location string                 `json:"location,omitempty"`
+		Params   map[string]interface{} `json:"params,omitempty"`
+	}{
+		Hash: Hash{
+			Label:    task.Label,
+			Interval: task.Interval,
+			Task:     task.Task,
+			ID:       task.ID,
+			Once:     task.Once,
+		},
+		Location: task.Location,
+		Params:   task.Params,
+	})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Reconcile makes the scheduler run exactly the given tasks: added tasks are started,
+// missing ones are removed, changed ones are restarted and unchanged ones keep running
+// with their state. Tasks without an ID are identified by TaskHash. Tasks that finished
+// or cancelled themselves stay stopped until their definition changes
+func (s *Scheduler) Reconcile(tasks []Task) (Reconciled, error) {
+	r := Reconciled{}
+	s.mu.Lock()
+	running := make(map[string]Task, len(s.jobs))
+	for id, j := range s.jobs {
+		running[id] = j.task
+	}
+	retired := make(map[string]string, len(s.retired))
+	for id, fp := range s.retired {
+		retired[id] = fp
+	}
+	s.mu.Unlock()
+	errs := []string{}
+	wanted := map[string]bool{}
+	for _, t := range tasks {
+		if len(t.ID) == 0 {
+			t.ID = TaskHash(t, "")
+		}
+		if wanted[t.ID] {
+			errs = append(errs, fmt.Sprintf("duplicate task ID %q", t.ID))
+			continue
+		}
+		wanted[t.ID] = true
+		fp := Fingerprint(t)
+		prev, ok := running[t.ID]
+		switch {
+		case ok && Fingerprint(prev) == fp:
+			r.Unchanged = append(r.Unchanged, t.ID)
+			continue
+		case !ok && retired[t.ID] == fp:
+			r.Unchanged = append(r.Unchanged, t.ID)
+			continue
+		case ok:
+			s.Remove(t.ID)
+			if prev.Task == t.Task { // Keep showing the last state until the next run
+				t.Date, t.Spark, t.Warn, t.Last = prev.Date, prev.Spark, prev.Warn, prev.Last
+			}
+			r.Changed = append(r.Changed, t.ID)
+		default:
+			r.Added = append(r.Added, t.ID)
+		}
+		s.mu.Lock()
+		delete(s.retired, t.ID)
+		s.mu.Unlock()
+		if err := s.Add(t); err != nil {
+			errs = append(errs, fmt.Sprintf("task %q: %s", t.ID, err))
+		}
+	}
+	for id := range running {
+		if !wanted[id] {
+			s.Remove(id)
+			r.Removed = append(r.Removed, id)
+		}
+	}
+	s.mu.Lock()
+	for id := range s.retired {
+		if !wanted[id] {
+			delete(s.retired, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, ids := range [][]string{r.Added, r.Removed, r.Changed, r.Unchanged} {
+		sort.Strings(ids)
+	}
+	if len(errs) > 0 {
+		return r, fmt.Errorf("reconcile failed: %s", strings.Join(errs, ", "))
+	}
+	return r, nil
+}
+
+// ConfigWatcher reloads config files when they change and reconciles a scheduler with them
+type ConfigWatcher struct {
+	Paths     []string
+	Scheduler *Scheduler
+	Poll      time.Duration           // How often to check files for changes, defaults to five seconds
+	OnReload  func(Reconciled, error) // Called after every reload, errors keep the running tasks
+	files     []string
+	stamps    map[string]string
+}
+
+// NewConfigWatcher creates a watcher for config files, directories and globs
+func NewConfigWatcher(scheduler *Scheduler, paths ...string) *ConfigWatcher {
+	return &ConfigWatcher{
+		Paths:     paths,
+		Scheduler: scheduler,
+		Poll:      5 * time.Second,
+	}
+}
+
+// Run loads the config and reloads it on changes until the context is done, it returns
+// early only if the first load fails
+func (w *ConfigWatcher) Run(ctx context.Context) error {
+	if err := w.reload(); err != nil {
+		return err
+	}
+	poll := w.Poll
+	if poll <= 0 {
+		poll = 5 * time.Second
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if w.changed() {
+				if err := w.reload(); err != nil && w.OnReload == nil {
+					log.Println(err)
+				}
+			}
+		}
+	}
+}
+
+// reload loads the config and reconciles the scheduler with it
+func (w *ConfigWatcher) reload() error {
+	cfg, err := LoadConfig(w.Paths...)
+	if err == nil {
+		w.files = cfg.Files
+		w.stamps = w.stamp()
+		var r Reconciled
+		r, err = w.Scheduler.Reconcile(cfg.Tasks)
+		if w.OnReload != nil {
+			w.OnReload(r, err)
+		}
+		return err
+	}
+	// Remember the broken files so they are only loaded again once they change
+	w.stamps = w.stamp()
+	if w.OnReload != nil {
+		w.OnReload(Reconciled{}, err)
+	}
+	return err
+}
+
+// changed reports if any watched file or directory changed since the last load
+func (w *ConfigWatcher) changed() bool {
+	stamps := w.stamp()
+	if len(stamps) != len(w.stamps) {
+		return true
+	}
+	for p, s := range stamps {
+		if w.stamps[p] != s {
+			return true
+		}
+	}
+	return false
+}
+
+// stamp records the size and modification time of the watched paths, the loaded files and
+// their directories, directories change when files are added or removed
+func (w *ConfigWatcher) stamp() map[string]string {
+	stamps := map[string]string{}
+	paths := append([]string{}, w.Paths...)
+	for _, f := range w.files {
+		paths = append(paths, f, filepath.Dir(f))
+	}
+	for _, p := range w.Paths {
+		if strings.ContainsAny(p, "*?[") {
+			paths = append(paths, filepath.Dir(p))
+		}
+	}
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			stamps[p] = fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return stamps
+}
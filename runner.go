@@ -0,0 +1,169 @@
+package tasks
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// RunnerFunc executes a task and returns its result
+type RunnerFunc func(*TaskArgs) Result
+
+// Middleware wraps a runner to add behavior around it, e.g. timing or logging
+type Middleware func(next RunnerFunc) RunnerFunc
+
+var (
+	middlewareMu sync.RWMutex
+	// middlewares wrap every runner
+	middlewares []Middleware
+	// typeMiddlewares wrap the runners of a UI type
+	typeMiddlewares = map[string][]Middleware{}
+	// taskMiddlewares wrap runners by runner name
+	taskMiddlewares = map[string][]Middleware{}
+)
+
+// Use registers middlewares around every runner, the first one registered runs first
+func Use(mw ...Middleware) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	middlewares = append(middlewares, mw...)
+}
+
+// UseForType registers middlewares around every runner of a UI type such as "http", which
+// includes prometheus and promql
+func UseForType(uiType string, mw ...Middleware) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	typeMiddlewares[uiType] = append(typeMiddlewares[uiType], mw...)
+}
+
+// UseForTask registers middlewares around a single runner by name such as "http-json"
+func UseForTask(task string, mw ...Middleware) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	taskMiddlewares[task] = append(taskMiddlewares[task], mw...)
+}
+
+// Run executes a task with its runner and middlewares, panics are turned into error
+// results and tasks that fail because of their config are cancelled. Secret references in
+// params are resolved for the runner only and secret values are redacted from the result
+func Run(args *TaskArgs) Result {
+	runner, ok := TaskRunners[args.Task.Task]
+	if !ok {
+		result := NewResult(args.Task)
+		result.Fail(NewError(ClassConfig, "unknown task type %q", args.Task.Task))
+		return cancelInvalid(args, result)
+	}
+	params, redactor, err := ResolveSecrets(args.Task.Params)
+	if err != nil {
+		result := NewResult(args.Task)
+		result.Fail(err)
+		return cancelInvalid(args, result)
+	}
+	resolved := *args
+	resolved.Task.Params = params
+	if args.Callback != nil { // Timerless runners report through the callback, redact those results too
+		resolved.Callback = func(result Result) {
+			args.Callback(redactor.Result(warnBlocked(result)))
+		}
+	}
+	runner.Func = redactor.runner(runner.Func)
+	return redactor.Result(warnBlocked(cancelInvalid(args, chain(args.Task.Task, runner)(&resolved))))
+}
+
+// chain wraps a runner with Recover, the global middlewares, then the UI type and runner
+// name middlewares
+func chain(name string, runner Type) RunnerFunc {
+	middlewareMu.RLock()
+	mws := append([]Middleware{Recover()}, middlewares...)
+	mws = append(mws, typeMiddlewares[runner.Type]...)
+	mws = append(mws, taskMiddlewares[name]...)
+	middlewareMu.RUnlock()
+	fn := runner.Func
+	for i := len(mws) - 1; i >= 0; i-- {
+		fn = mws[i](fn)
+	}
+	return fn
+}
+
+// Recover turns runner panics into error results, Run always adds it first
+func Recover() Middleware {
+	return func(next RunnerFunc) RunnerFunc {
+		return func(args *TaskArgs) (result Result) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("task %q panicked: %v\n%s", args.Task.ID, r, debug.Stack())
+					result = NewResult(args.Task)
+					result.Fail(NewError(ClassPanic, "task runner panicked: %v", r))
+				}
+			}()
+			return next(args)
+		}
+	}
+}
+
+// Timing calls observe with how long each run took
+func Timing(observe func(task Task, took time.Duration, result Result)) Middleware {
+	return func(next RunnerFunc) RunnerFunc {
+		return func(args *TaskArgs) Result {
+			start := time.Now()
+			result := next(args)
+			observe(args.Task, time.Since(start), result)
+			return result
+		}
+	}
+}
+
+// Logging writes a key=value line for each run, logger defaults to the standard logger
+func Logging(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next RunnerFunc) RunnerFunc {
+		return func(args *TaskArgs) Result {
+			start := time.Now()
+			result := next(args)
+			line := fmt.Sprintf("task=%q id=%q type=%q took=%s warn=%t", args.Task.Task, args.Task.ID, TaskRunners[args.Task.Task].Type, time.Since(start), result.Warn)
+			if te := ClassifyError(result.Error); te != nil {
+				line += fmt.Sprintf(" error_class=%s retryable=%t error=%q", te.Class, te.Retryable, te.Message)
+			}
+			logger.Println(line)
+			return result
+		}
+	}
+}
+
+// warnBlocked marks results whose target was blocked by TargetPolicy as a warning, the
+// task keeps running so the denial is reported on every run
+func warnBlocked(result Result) Result {
+	if te := ClassifyError(result.Error); te != nil && te.Class == ClassPolicy {
+		result.Warn = true
+		if result.Spark != nil {
+			result.Spark.Warn = true
+		}
+	}
+	return result
+}
+
+// cancelInvalid cancels a task when its result has a config error, retrying will never help
+func cancelInvalid(args *TaskArgs, result Result) Result {
+	te := ClassifyError(result.Error)
+	if te == nil || te.Class != ClassConfig || result.Cancelled {
+		return result
+	}
+	if len(result.ID) == 0 {
+		base := NewResult(args.Task)
+		base.Spark, base.Warn, base.Update = result.Spark, result.Warn, result.Update
+		result = base
+	}
+	result.Fail(te)
+	if args.Task.Cancel != nil {
+		result.Cancelled = args.Task.Cancel()
+	}
+	if result.Cancelled {
+		result.Notification = fmt.Sprintf("task cancelled because of an invalid config: %s", te.Message)
+	}
+	return result
+}
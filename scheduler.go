@@ -0,0 +1,449 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+var (
+	// cronParser accepts standard cron expressions, an optional seconds field
+	// and descriptors such as @hourly or @every 5m
+	cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+	// uptimeRefresh is how often the availability added to results is calculated again
+	uptimeRefresh = time.Minute
+)
+
+// Schedule returns the next time a task should run after the given time
+type Schedule interface {
+	Next(time.Time) time.Time
+}
+
+// every is a fixed duration schedule
+type every time.Duration
+
+// Next returns the given time plus the duration
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// ParseInterval parses a task interval, either a Go duration such as "30s"
+// or a cron expression such as "*/5 * * * *"
+func ParseInterval(interval string) (Schedule, error) {
+	if d, err := time.ParseDuration(interval); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("interval must be positive: %q", interval)
+		}
+		return every(d), nil
+	}
+	schedule, err := cronParser.Parse(interval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interval %q: %w", interval, err)
+	}
+	return schedule, nil
+}
+
+// SchedulerOptions configures a Scheduler
+type SchedulerOptions struct {
+	Workers  int            // Max tasks running at once, defaults to 10
+	Limits   map[string]int // Max tasks running at once per UI type, e.g. "ping"
+	Jitter   time.Duration  // Max random delay added to each run to spread load
+	Results  chan Result    // Receives every result when set
+	Callback func(Result)   // Called with every result when set
+	Redis    Redis          // Passed to runners that use Redis
+	Cluster  *Cluster       // Shares tasks and results with other instances when set
+	History  History        // Stores every result when set
+	Uptime   string         // Adds availability over this window to result updates, e.g. "30d", requires History
+	Target   float64        // Availability target percent for the error budget, defaults to 99.9
+	Metrics  *Exporter      // Exports every result as Prometheus metrics when set
+}
+
+// Scheduler runs tasks by their interval on a bounded worker pool
+type Scheduler struct {
+	options SchedulerOptions
+	workers chan struct{}
+	limits  map[string]chan struct{}
+	mu      sync.Mutex
+	jobs    map[string]*job
+	retired map[string]string // Fingerprints of tasks that removed themselves, by task ID
+	uptime  map[string]uptimeCache
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// job is a task registered with the scheduler
+type job struct {
+	task     Task
+	schedule Schedule
+	ctx      context.Context
+	cancel   context.CancelFunc
+	retired  bool // The job removed itself, its last result is still delivered
+}
+
+// NewScheduler creates a scheduler, call Start to begin running tasks
+func NewScheduler(options SchedulerOptions) *Scheduler {
+	if options.Workers <= 0 {
+		options.Workers = 10
+	}
+	if options.Target <= 0 {
+		options.Target = 99.9
+	}
+	s := &Scheduler{
+		options: options,
+		workers: make(chan struct{}, options.Workers),
+		limits:  map[string]chan struct{}{},
+		jobs:    map[string]*job{},
+		retired: map[string]string{},
+		uptime:  map[string]uptimeCache{},
+	}
+	for t, limit := range options.Limits {
+		if limit > 0 {
+			s.limits[t] = make(chan struct{}, limit)
+		}
+	}
+	return s
+}
+
+// Start begins running all added tasks until the context is done or Stop is called
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx != nil {
+		return
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	if c := s.cluster(); c != nil {
+		s.wg.Add(2)
+		go func() {
+			defer s.wg.Done()
+			c.Renew(s.ctx)
+		}()
+		go func() {
+			defer s.wg.Done()
+			c.Subscribe(s.ctx, s.receive)
+		}()
+	}
+	for _, j := range s.jobs {
+		s.start(j)
+	}
+}
+
+// Stop cancels all tasks and waits for running tasks to finish
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	if c := s.cluster(); c != nil {
+		c.ReleaseAll()
+	}
+}
+
+// Add registers a task, it starts right away if the scheduler is running
+func (s *Scheduler) Add(task Task) error {
+	if len(task.ID) == 0 {
+		return fmt.Errorf("task %q is missing an ID", task.Label)
+	}
+	runner, ok := TaskRunners[task.Task]
+	if !ok {
+		return fmt.Errorf("unknown task type %q", task.Task)
+	}
+	j := &job{task: task}
+	if !task.Once && !runner.Timerless {
+		schedule, err := ParseInterval(task.Interval)
+		if err != nil {
+			return err
+		}
+		j.schedule = schedule
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.jobs[task.ID]; exists {
+		return fmt.Errorf("task %q already exists", task.ID)
+	}
+	s.jobs[task.ID] = j
+	if s.ctx != nil {
+		s.start(j)
+	}
+	return nil
+}
+
+// Remove stops a task and removes it from the scheduler
+func (s *Scheduler) Remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove(id)
+}
+
+// remove stops a task and removes it from the scheduler, s.mu must be held
+func (s *Scheduler) remove(id string) bool {
+	j, ok := s.jobs[id]
+	if ok {
+		delete(s.jobs, id)
+		if j.cancel != nil {
+			j.cancel()
+		}
+		if c := s.cluster(); c != nil {
+			if err := c.Release(id); err != nil {
+				log.Println(err)
+			}
+		}
+		if m := s.options.Metrics; m != nil {
+			m.Forget(j.task)
+		}
+		delete(s.uptime, id)
+	}
+	return ok
+}
+
+// cluster returns the cluster when it is set and has Redis enabled
+func (s *Scheduler) cluster() *Cluster {
+	if c := s.options.Cluster; c.Enabled() {
+		return c
+	}
+	return nil
+}
+
+// retire removes a job that finished or cancelled itself, Reconcile leaves it stopped
+// until its definition changes. Jobs that were already replaced are left alone
+func (s *Scheduler) retire(j *job) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := j.task.ID
+	if s.jobs[id] != j {
+		return false
+	}
+	s.retired[id] = Fingerprint(j.task)
+	j.retired = true
+	return s.remove(id)
+}
+
+// Tasks returns a copy of every registered task with its latest state
+func (s *Scheduler) Tasks() []Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tasks := make([]Task, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		tasks = append(tasks, j.task)
+	}
+	return tasks
+}
+
+// start launches the loop for a job, s.mu must be held
+func (s *Scheduler) start(j *job) {
+	j.ctx, j.cancel = context.WithCancel(s.ctx)
+	j.task.CTX = j.ctx
+	j.task.Cancel = func() bool {
+		return s.retire(j)
+	}
+	s.wg.Add(1)
+	go s.loop(j)
+}
+
+// loop waits for each scheduled time and runs the job
+func (s *Scheduler) loop(j *job) {
+	defer s.wg.Done()
+	next := time.Now().Add(s.jitter())
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-j.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.run(j)
+		if j.schedule == nil {
+			if j.task.Once {
+				s.retire(j)
+			}
+			// Timerless tasks report through callbacks until removed
+			<-j.ctx.Done()
+			return
+		}
+		next = j.schedule.Next(time.Now()).Add(s.jitter())
+	}
+}
+
+// run executes a job once it has a free worker and a free slot for its type
+func (s *Scheduler) run(j *job) {
+	runner := TaskRunners[j.task.Task]
+	if limit, ok := s.limits[runner.Type]; ok {
+		select {
+		case limit <- struct{}{}:
+			defer func() { <-limit }()
+		case <-j.ctx.Done():
+			return
+		}
+	}
+	select {
+	case s.workers <- struct{}{}:
+		defer func() { <-s.workers }()
+	case <-j.ctx.Done():
+		return
+	}
+	s.mu.Lock()
+	task := j.task
+	s.mu.Unlock()
+	c := s.cluster()
+	if c != nil && !runner.Timerless {
+		// Another instance holds the lease, its results arrive through Subscribe
+		if ok, err := c.Acquire(task.ID); err != nil {
+			log.Println(err) // Run locally rather than not at all
+		} else if !ok {
+			return
+		} else if task.Once {
+			// Keep the lease after the run so instances whose timer fires later skip the task
+			defer func() {
+				if err := c.Keep(task.ID, c.Horizon+s.options.Jitter); err != nil {
+					log.Println(err)
+				}
+			}()
+		}
+	}
+	args := &TaskArgs{
+		Task: task,
+		Callback: func(result Result) {
+			s.deliver(j, result, 0)
+		},
+		Stop: func() {
+			s.retire(j)
+		},
+		Redis: s.options.Redis,
+	}
+	start := time.Now()
+	result := Run(args)
+	s.deliver(j, result, time.Since(start))
+}
+
+// deliver fills in missing result details, saves the task state and sends the result out,
+// took is how long the runner took or zero for callback results. Results of jobs that were
+// replaced or removed, e.g. by Reconcile, are dropped so they are not recorded twice
+func (s *Scheduler) deliver(j *job, result Result, took time.Duration) {
+	s.mu.Lock()
+	task := j.task
+	if s.jobs[task.ID] != j && !j.retired {
+		s.mu.Unlock()
+		return
+	}
+	if len(result.ID) == 0 {
+		if result.Error == nil && !result.Cancelled {
+			s.mu.Unlock()
+			return // Nothing to report, e.g. a callback was registered
+		}
+		base := NewResult(task)
+		result.Task, result.Label, result.ID, result.Date, result.Event = base.Task, base.Label, base.ID, base.Date, base.Event
+	}
+	if len(result.Location) == 0 {
+		result.Location = task.Location
+	}
+	if result.Error != nil && len(result.ErrorString) == 0 {
+		result.ErrorString = result.Error.Error()
+	}
+	j.save(result)
+	s.mu.Unlock()
+	s.record(&result, took)
+	if c := s.cluster(); c != nil {
+		if err := c.Publish(result); err != nil {
+			log.Println(err)
+		}
+	}
+	s.emit(result)
+}
+
+// receive handles a result that ran on another instance
+func (s *Scheduler) receive(result Result) {
+	s.mu.Lock()
+	if j, ok := s.jobs[result.ID]; ok {
+		j.save(result)
+	}
+	s.mu.Unlock()
+	s.record(&result, 0)
+	s.emit(result)
+}
+
+// record exports metrics, adds a result to the history and attaches the task availability
+func (s *Scheduler) record(result *Result, took time.Duration) {
+	if m := s.options.Metrics; m != nil {
+		m.Record(*result, took)
+	}
+	if s.options.History == nil {
+		return
+	}
+	if err := s.options.History.Add(result.ID, NewPoint(*result)); err != nil {
+		log.Println(err)
+	}
+	if len(s.options.Uptime) > 0 {
+		if a, ok := s.availability(*result); ok {
+			result.Update = uptimeUpdate{result.Update, a}
+		}
+	}
+}
+
+// uptimeCache is the last availability calculated for a task
+type uptimeCache struct {
+	availability Availability
+	at           time.Time
+	down         bool
+}
+
+// availability returns the task availability, it is only calculated again from the
+// history once uptimeRefresh passed or the task went up or down
+func (s *Scheduler) availability(result Result) (Availability, bool) {
+	down := NewPoint(result).down()
+	s.mu.Lock()
+	cached, ok := s.uptime[result.ID]
+	s.mu.Unlock()
+	if ok && cached.down == down && time.Since(cached.at) < uptimeRefresh {
+		return cached.availability, true
+	}
+	a, err := TaskUptime(s.options.History, result.ID, s.options.Uptime, s.options.Target)
+	if err != nil {
+		log.Println(err)
+		return a, false
+	}
+	s.mu.Lock()
+	s.uptime[result.ID] = uptimeCache{a, time.Now(), down}
+	s.mu.Unlock()
+	return a, true
+}
+
+// emit sends a result to the configured callback and channel
+func (s *Scheduler) emit(result Result) {
+	if s.options.Callback != nil {
+		s.options.Callback(result)
+	}
+	if s.options.Results != nil {
+		select {
+		case s.options.Results <- result:
+		case <-s.ctx.Done():
+		}
+	}
+}
+
+// save keeps the latest result details on the task, s.mu must be held
+func (j *job) save(result Result) {
+	j.task.Date = result.Date
+	j.task.Spark = result.Spark
+	j.task.Warn = result.Warn
+	j.task.Cancelled = result.Cancelled
+	if result.Update != nil {
+		j.task.Last = result.Update
+	}
+}
+
+// jitter returns a random delay up to the configured jitter
+func (s *Scheduler) jitter() time.Duration {
+	if s.options.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.options.Jitter)))
+}
@@ -0,0 +1,265 @@
+package tasks
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// redacted replaces secret values in results and logs
+	redacted = "[redacted]"
+	// minSecretLength skips redacting tiny values that would mangle every message
+	minSecretLength = 4
+)
+
+var (
+	// SecretProviders resolve ${scheme:ref} references in task params by scheme
+	SecretProviders = map[string]SecretProvider{
+		"env":  SecretFunc(envSecret),
+		"file": SecretFunc(fileSecret),
+	}
+	// SecretEnvPrefixes are the environment variable prefixes ${env:NAME} may read, other
+	// variables such as REDIS_PASSWORD stay out of reach of task configs
+	SecretEnvPrefixes = []string{"GODASH_SECRET_"}
+	// SecretDir is the directory ${file:name} may read from, relative names are joined to it
+	SecretDir = "/run/secrets"
+	// SensitiveParams are param name fragments whose values are always redacted, names are
+	// matched in lower case without "-" and "_"
+	SensitiveParams = []string{"token", "password", "passwd", "secret", "apikey", "bearer", "authorization", "credential", "privatekey", "passphrase"}
+	// secretRef matches a secret reference such as ${env:GODASH_SECRET_NAME} or ${file:name}
+	secretRef = regexp.MustCompile(`\$\{([a-z][a-z0-9_-]*):([^}]+)\}`)
+)
+
+// SecretProvider resolves a secret reference to its value
+type SecretProvider interface {
+	Resolve(ref string) (string, error)
+}
+
+// SecretFunc lets a plain function be used as a SecretProvider
+type SecretFunc func(ref string) (string, error)
+
+// Resolve calls the function
+func (f SecretFunc) Resolve(ref string) (string, error) {
+	return f(ref)
+}
+
+// Redactor removes secret values from strings
+type Redactor struct {
+	values []string
+}
+
+// ResolveSecrets returns a copy of params with every secret reference resolved, and a
+// Redactor for the resolved secrets and the values of sensitive params
+func ResolveSecrets(params map[string]interface{}) (map[string]interface{}, *Redactor, error) {
+	r := &Redactor{}
+	resolved, err := r.resolve(params, false)
+	if err != nil {
+		return nil, r, err
+	}
+	sort.Slice(r.values, func(i, j int) bool {
+		return len(r.values[i]) > len(r.values[j]) // Longest first so overlapping secrets are fully removed
+	})
+	out, _ := resolved.(map[string]interface{})
+	return out, r, nil
+}
+
+// resolve walks a param value, sensitive is set for values below a sensitive param name
+func (r *Redactor) resolve(v interface{}, sensitive bool) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v == nil {
+			return v, nil
+		}
+		out := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			resolved, err := r.resolve(val, sensitive || isSensitive(k))
+			if err != nil {
+				return nil, err
+			}
+			out[k] = resolved
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, val := range v {
+			resolved, err := r.resolve(val, sensitive)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = resolved
+		}
+		return out, nil
+	case string:
+		var err error
+		s := secretRef.ReplaceAllStringFunc(v, func(ref string) string {
+			m := secretRef.FindStringSubmatch(ref)
+			provider, ok := SecretProviders[m[1]]
+			if !ok {
+				if err == nil {
+					err = NewError(ClassConfig, "unknown secret provider %q", m[1])
+				}
+				return ref
+			}
+			secret, e := provider.Resolve(m[2])
+			if e != nil {
+				if err == nil {
+					err = lookupError(ref, e)
+				}
+				return ref
+			}
+			r.add(secret)
+			return secret
+		})
+		if err != nil {
+			return nil, err
+		}
+		if sensitive {
+			r.add(s)
+		}
+		return s, nil
+	}
+	return v, nil
+}
+
+// lookupError classifies a failed secret lookup, it never cancels the task as a variable
+// that is not exported yet or a file being rotated may resolve on the next run
+func lookupError(ref string, err error) error {
+	te := ClassifyError(err)
+	class := te.Class
+	if class == ClassConfig {
+		class = ClassUnknown
+	}
+	return &TaskError{
+		Class:     class,
+		Message:   fmt.Sprintf("secret %s could not be resolved: %s", ref, err),
+		Retryable: retryable[class],
+		Err:       err,
+	}
+}
+
+// add registers a secret value along with the quoted and URL escaped forms it may take in
+// error messages
+func (r *Redactor) add(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+	quoted := strconv.Quote(secret)
+	for _, s := range []string{secret, quoted[1 : len(quoted)-1], url.QueryEscape(secret), url.PathEscape(secret)} {
+		if !r.has(s) {
+			r.values = append(r.values, s)
+		}
+	}
+}
+
+func (r *Redactor) has(s string) bool {
+	for _, v := range r.values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact replaces every secret value in a string
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, v := range r.values {
+		s = strings.ReplaceAll(s, v, redacted)
+	}
+	return s
+}
+
+// Result redacts the notification and error messages of a result, errors that held a
+// secret lose their underlying error
+func (r *Redactor) Result(result Result) Result {
+	if r == nil || len(r.values) == 0 {
+		return result
+	}
+	result.Notification = r.Redact(result.Notification)
+	result.ErrorString = r.Redact(result.ErrorString)
+	if result.Error != nil {
+		if msg := r.Redact(result.Error.Error()); msg != result.Error.Error() {
+			te := *ClassifyError(result.Error)
+			te.Message, te.Err = msg, nil
+			result.Error = &te
+		}
+	}
+	return result
+}
+
+// runner wraps a runner so middlewares only see redacted results
+func (r *Redactor) runner(next RunnerFunc) RunnerFunc {
+	return func(args *TaskArgs) Result {
+		return r.Result(next(args))
+	}
+}
+
+// isSensitive reports if a param name holds a secret
+func isSensitive(name string) bool {
+	name = strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(name))
+	for _, s := range SensitiveParams {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// envSecret reads a secret from an environment variable with one of SecretEnvPrefixes
+func envSecret(name string) (string, error) {
+	allowed := false
+	for _, prefix := range SecretEnvPrefixes {
+		allowed = allowed || strings.HasPrefix(name, prefix)
+	}
+	if !allowed {
+		return "", NewError(ClassPermission, "environment variable %s does not start with %s", name, strings.Join(SecretEnvPrefixes, " or "))
+	}
+	if v, ok := os.LookupEnv(name); ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("environment variable %s is not set", name)
+}
+
+// fileSecret reads a secret from a file in SecretDir, trailing new lines are removed.
+// The path is checked before and after following symlinks so neither ".." nor a link can
+// point outside of it
+func fileSecret(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(SecretDir, path)
+	}
+	path = filepath.Clean(path)
+	if !inDir(filepath.Clean(SecretDir), path) {
+		return "", NewError(ClassPermission, "%s is outside of the secrets directory %s", path, SecretDir)
+	}
+	dir, err := filepath.EvalSymlinks(SecretDir)
+	if err != nil {
+		return "", err
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if !inDir(dir, target) {
+		return "", NewError(ClassPermission, "%s is outside of the secrets directory %s", path, SecretDir)
+	}
+	b, err := ioutil.ReadFile(target)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// inDir reports if a clean path is below dir
+func inDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
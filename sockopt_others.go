@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package tasks
+
+import "syscall"
+
+// setTTL returns a dialer Control func that sets the IPv4 TTL of the socket. When bound is
+// set the socket is bound to a port picked by the kernel, which is passed to bound before
+// the connection is made
+func setTTL(ttl int, bound func(port int)) func(string, string, syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			if err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl); err != nil || bound == nil {
+				return
+			}
+			if err = syscall.Bind(int(fd), &syscall.SockaddrInet4{}); err != nil {
+				return
+			}
+			var sa syscall.Sockaddr
+			if sa, err = syscall.Getsockname(int(fd)); err == nil {
+				if in4, ok := sa.(*syscall.SockaddrInet4); ok {
+					bound(in4.Port)
+				}
+			}
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
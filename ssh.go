@@ -0,0 +1,254 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"pkg.goda.sh/utils"
+)
+
+// sshRecorder keeps the first bytes sent by an SSH server, they hold its version and the
+// algorithms it offers
+type sshRecorder struct {
+	net.Conn
+	mu  sync.Mutex
+	buf []byte
+}
+
+// Read records the bytes read from the server
+func (r *sshRecorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.mu.Lock()
+	if len(r.buf) < 32768 {
+		r.buf = append(r.buf, b[:n]...)
+	}
+	r.mu.Unlock()
+	return n, err
+}
+
+// server parses the version and the kex and host key algorithms from the recorded bytes
+func (r *sshRecorder) server() (version string, kex []string, hostKeys []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	buf := r.buf
+	for len(buf) > 0 { // Servers may send other lines before the version
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			return "", nil, nil
+		}
+		line := strings.TrimSpace(string(buf[:i]))
+		buf = buf[i+1:]
+		if strings.HasPrefix(line, "SSH-") {
+			version = line
+			break
+		}
+	}
+	// Binary packet: uint32 length, byte padding, payload starting with SSH_MSG_KEXINIT (20)
+	// and a 16 byte cookie, followed by the name lists
+	if len(buf) < 22 || buf[5] != 20 {
+		return version, nil, nil
+	}
+	payload := buf[22:]
+	lists := [][]string{}
+	for i := 0; i < 2; i++ {
+		if len(payload) < 4 {
+			break
+		}
+		n := int(binary.BigEndian.Uint32(payload))
+		if len(payload) < 4+n {
+			break
+		}
+		lists = append(lists, strings.Split(string(payload[4:4+n]), ","))
+		payload = payload[4+n:]
+	}
+	if len(lists) == 2 {
+		kex, hostKeys = lists[0], lists[1]
+	}
+	return version, kex, hostKeys
+}
+
+// SSH performs an SSH handshake and reports the server version, offered algorithms, host
+// key fingerprint and auth methods. It warns when the fingerprint does not match a pinned
+// "fingerprint" or when the host key or auth methods changed since the previous run. A
+// "key", usually a secret such as ${file:id_ed25519}, is used to test authentication
+func SSH(args *TaskArgs) Result {
+	result := NewResult(args.Task)
+	params := utils.ParamsParser(args.Task.Params, utils.DefaultParams{
+		"timeout": "10s",
+		"user":    strings.ToLower(Project),
+	})
+	target := params.Get("target").String()
+	user := params.Get("user").String()
+	timeout, err := time.ParseDuration(params.Get("timeout").String())
+	if err != nil || timeout <= 0 {
+		result.Fail(NewError(ClassConfig, "invalid timeout %q", params.Get("timeout").String()))
+		return result
+	}
+	if len(target) == 0 {
+		result.Fail(NewError(ClassConfig, "missing target"))
+		return result
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(strings.Trim(target, "[]"), "22")
+	}
+	var signer ssh.Signer
+	if key := params.Get("key").String(); len(key) > 0 {
+		if passphrase := params.Get("passphrase").String(); len(passphrase) > 0 {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(key), []byte(passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey([]byte(key))
+		}
+		if err != nil {
+			result.Fail(NewError(ClassConfig, "invalid key: %s", err))
+			return result
+		}
+	}
+	// The handshake uses callbacks that fail on purpose, the server only offers the methods
+	// it accepts so each call reveals an auth method without sending credentials
+	methods := map[string]bool{}
+	var hostKey ssh.PublicKey
+	config := &ssh.ClientConfig{
+		User: user,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return nil
+		},
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				methods["publickey"] = true
+				return nil, errors.New("probe")
+			}),
+			ssh.PasswordCallback(func() (string, error) {
+				methods["password"] = true
+				return "", errors.New("probe")
+			}),
+			ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				methods["keyboard-interactive"] = true
+				return nil, errors.New("probe")
+			}),
+		},
+	}
+	if algorithms := paramList(args.Task.Params["host_key_algorithms"]); len(algorithms) > 0 {
+		config.HostKeyAlgorithms = algorithms // Pick the host key to check against the pins
+	}
+	start := time.Now()
+	recorder, err := sshHandshake(target, config, timeout)
+	elapsed := time.Since(start)
+	if hostKey == nil {
+		if err == nil {
+			err = NewError(ClassParse, "%s did not send a host key", target)
+		}
+		result.Fail(err)
+		return result
+	}
+	version, kex, hostKeys := recorder.server()
+	fingerprint := ssh.FingerprintSHA256(hostKey)
+	auth := []string{}
+	for m := range methods {
+		auth = append(auth, m)
+	}
+	sort.Strings(auth)
+	problems := []string{}
+	if pins := paramList(args.Task.Params["fingerprint"]); len(pins) > 0 {
+		if !sshPinned(hostKey, pins) {
+			problems = append(problems, fmt.Sprintf("host key %s does not match the pinned fingerprint", fingerprint))
+		}
+	} else if last := lastUpdate(args.Task.Last, "fingerprint").String(); len(last) > 0 && last != fingerprint && lastUpdate(args.Task.Last, "key_type").String() == hostKey.Type() {
+		problems = append(problems, fmt.Sprintf("host key changed from %s to %s", last, fingerprint))
+	}
+	expected := paramList(args.Task.Params["auth_methods"])
+	if len(expected) == 0 {
+		for _, m := range lastUpdate(args.Task.Last, "auth_methods").Array() {
+			expected = append(expected, m.String())
+		}
+	}
+	if len(expected) > 0 {
+		sort.Strings(expected)
+		if strings.Join(expected, ",") != strings.Join(auth, ",") {
+			problems = append(problems, fmt.Sprintf("auth methods changed from %s to %s", strings.Join(expected, ", "), strings.Join(auth, ", ")))
+		}
+	}
+	authenticated := false
+	if signer != nil {
+		_, err := sshHandshake(target, &ssh.ClientConfig{
+			User:              user,
+			Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyAlgorithms: config.HostKeyAlgorithms,
+			HostKeyCallback:   ssh.FixedHostKey(hostKey),
+		}, timeout)
+		if err != nil {
+			result.Fail(NewError(ClassPermission, "authentication as %s failed: %s", user, err))
+		}
+		authenticated = err == nil
+	}
+	result.Warn = len(problems) > 0 || result.Error != nil
+	if len(problems) > 0 {
+		result.Notification = fmt.Sprintf("SSH check of %s: %s!", target, strings.Join(problems, ", "))
+	}
+	result.Spark = &Spark{
+		millis64(elapsed),
+		result.Warn,
+	}
+	result.Update = struct {
+		Version           string   `json:"version"`
+		KeyType           string   `json:"key_type"`
+		Fingerprint       string   `json:"fingerprint"`
+		Kex               []string `json:"kex,omitempty"`
+		HostKeyAlgorithms []string `json:"host_key_algorithms,omitempty"`
+		AuthMethods       []string `json:"auth_methods"`
+		Authenticated     bool     `json:"authenticated,omitempty"`
+		Time              float64  `json:"time"`
+	}{
+		Version:           version,
+		KeyType:           hostKey.Type(),
+		Fingerprint:       fingerprint,
+		Kex:               kex,
+		HostKeyAlgorithms: hostKeys,
+		AuthMethods:       auth,
+		Authenticated:     authenticated,
+		Time:              millis64(elapsed),
+	}
+	return result
+}
+
+// sshHandshake connects to an SSH server through TargetPolicy and authenticates, the
+// returned recorder holds what the server sent even when the handshake failed
+func sshHandshake(target string, config *ssh.ClientConfig, timeout time.Duration) (*sshRecorder, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := TargetPolicy.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return &sshRecorder{}, err
+	}
+	recorder := &sshRecorder{Conn: conn}
+	defer recorder.Close()
+	recorder.SetDeadline(time.Now().Add(timeout))
+	c, chans, reqs, err := ssh.NewClientConn(recorder, target, config)
+	if err != nil {
+		return recorder, err
+	}
+	defer ssh.NewClient(c, chans, reqs).Close()
+	return recorder, nil
+}
+
+// sshPinned reports if a host key matches any of the pinned SHA256 or MD5 fingerprints
+func sshPinned(key ssh.PublicKey, pins []string) bool {
+	sha := ssh.FingerprintSHA256(key)
+	md5 := ssh.FingerprintLegacyMD5(key)
+	for _, pin := range pins {
+		pin = strings.TrimSpace(pin)
+		if strings.TrimRight(strings.TrimPrefix(pin, "SHA256:"), "=") == strings.TrimPrefix(sha, "SHA256:") || strings.EqualFold(strings.TrimPrefix(pin, "MD5:"), md5) {
+			return true
+		}
+	}
+	return false
+}
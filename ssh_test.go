@@ -0,0 +1,164 @@
+package tasks
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshServer starts an in-process SSH server that accepts the client key and offers
+// publickey and password auth, it returns the address and the host key
+func sshServer(t *testing.T, client ssh.PublicKey) (string, ssh.PublicKey) {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		ServerVersion: "SSH-2.0-Test_1.0",
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), client.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("wrong password")
+		},
+	}
+	config.AddHostKey(signer)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn, chans, reqs, err := ssh.NewServerConn(c, config)
+				if err != nil {
+					c.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				go func() {
+					for ch := range chans {
+						ch.Reject(ssh.Prohibited, "no sessions")
+					}
+				}()
+				conn.Wait()
+			}()
+		}
+	}()
+	return ln.Addr().String(), signer.PublicKey()
+}
+
+// sshKey generates a client key, returning its public key and PEM private key
+func sshKey(t *testing.T) (ssh.PublicKey, string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(block))
+}
+
+func TestSSH(t *testing.T) {
+	client, key := sshKey(t)
+	_, otherKey := sshKey(t)
+	target, hostKey := sshServer(t, client)
+	fingerprint := ssh.FingerprintSHA256(hostKey)
+	tests := []struct {
+		name   string
+		params map[string]interface{}
+		last   interface{}
+		warn   bool
+		auth   bool
+	}{
+		{
+			name:   "pinned fingerprint",
+			params: map[string]interface{}{"target": target, "fingerprint": fingerprint},
+		},
+		{
+			name:   "pinned legacy MD5 fingerprint",
+			params: map[string]interface{}{"target": target, "fingerprint": []interface{}{"SHA256:other", ssh.FingerprintLegacyMD5(hostKey)}},
+		},
+		{
+			name:   "fingerprint mismatch",
+			params: map[string]interface{}{"target": target, "fingerprint": "SHA256:aGVsbG8gd29ybGQ"},
+			warn:   true,
+		},
+		{
+			name:   "host key changed since the last run",
+			params: map[string]interface{}{"target": target},
+			last:   map[string]interface{}{"fingerprint": "SHA256:old", "key_type": hostKey.Type()},
+			warn:   true,
+		},
+		{
+			name:   "expected auth methods",
+			params: map[string]interface{}{"target": target, "auth_methods": []interface{}{"password", "publickey"}},
+		},
+		{
+			name:   "auth methods changed",
+			params: map[string]interface{}{"target": target, "auth_methods": "publickey"},
+			warn:   true,
+		},
+		{
+			name:   "key authentication",
+			params: map[string]interface{}{"target": target, "key": key, "user": "monitor"},
+			auth:   true,
+		},
+		{
+			name:   "rejected key",
+			params: map[string]interface{}{"target": target, "key": otherKey},
+			warn:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := Run(&TaskArgs{Task: Task{ID: "ssh", Task: "ssh", Params: tt.params, Last: tt.last}})
+			if result.Warn != tt.warn {
+				t.Fatalf("warn = %t, want %t: %s %v", result.Warn, tt.warn, result.Notification, result.Error)
+			}
+			if got := lastUpdate(result.Update, "fingerprint").String(); got != fingerprint {
+				t.Errorf("fingerprint = %q, want %q", got, fingerprint)
+			}
+			if got := lastUpdate(result.Update, "version").String(); got != "SSH-2.0-Test_1.0" {
+				t.Errorf("version = %q", got)
+			}
+			methods := []string{}
+			for _, m := range lastUpdate(result.Update, "auth_methods").Array() {
+				methods = append(methods, m.String())
+			}
+			if got := strings.Join(methods, ","); got != "password,publickey" {
+				t.Errorf("auth methods = %q, want password,publickey", got)
+			}
+			if got := lastUpdate(result.Update, "authenticated").Bool(); got != tt.auth {
+				t.Errorf("authenticated = %t, want %t", got, tt.auth)
+			}
+		})
+	}
+}
@@ -0,0 +1,434 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"pkg.goda.sh/utils"
+)
+
+// hop is a router on the path to a traceroute target, times are in milliseconds
+type hop struct {
+	TTL  int     `json:"ttl"`
+	Addr string  `json:"addr,omitempty"`
+	Host string  `json:"host,omitempty"`
+	Sent int     `json:"sent"`
+	Recv int     `json:"recv"`
+	Loss float64 `json:"loss"`
+	Avg  float64 `json:"avg"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+}
+
+// traceReply is an answer to a traceroute probe
+type traceReply struct {
+	addr string
+	rtt  time.Duration
+}
+
+// traceProbe is a traceroute packet waiting for a reply
+type traceProbe struct {
+	ttl  int
+	sent time.Time
+}
+
+// tracer matches ICMP replies to the probes of a single traceroute
+type tracer struct {
+	mu      sync.Mutex
+	dst     net.IP
+	proto   string
+	id      int // ICMP echo ID or local UDP port
+	probes  map[int]*traceProbe
+	sent    map[int]int
+	replies map[int][]traceReply
+	reached int // Lowest TTL that reached the target
+}
+
+// Traceroute traces the IPv4 path to a target with UDP, ICMP or TCP probes and reports the
+// address, reverse DNS, loss and latency of every hop. It warns when the path differs from
+// the previous run, the target is not reached or a responding hop loses too many probes.
+// Reading ICMP replies needs a raw socket, e.g. CAP_NET_RAW
+func Traceroute(args *TaskArgs) Result {
+	result := NewResult(args.Task)
+	params := utils.ParamsParser(args.Task.Params, utils.DefaultParams{
+		"protocol": "udp",
+		"max_hops": 30,
+		"queries":  3,
+		"timeout":  "1s",
+		"loss":     50,
+	})
+	target := params.Get("target").String()
+	proto := params.Get("protocol").String()
+	maxHops := int(params.Get("max_hops").Int64())
+	queries := int(params.Get("queries").Int64())
+	timeout, err := time.ParseDuration(params.Get("timeout").String())
+	switch {
+	case len(target) == 0:
+		err = NewError(ClassConfig, "missing target")
+	case proto != "udp" && proto != "icmp" && proto != "tcp":
+		err = NewError(ClassConfig, "invalid protocol %q, expected udp, icmp or tcp", proto)
+	case maxHops < 1 || maxHops > 64:
+		err = NewError(ClassConfig, "max_hops must be between 1 and 64")
+	case queries < 1 || queries > 10:
+		err = NewError(ClassConfig, "queries must be between 1 and 10")
+	case err != nil || timeout <= 0:
+		err = NewError(ClassConfig, "invalid timeout %q", params.Get("timeout").String())
+	}
+	if err != nil {
+		result.Fail(err)
+		return result
+	}
+	port := int(params.Get("port").Int64())
+	if port == 0 {
+		port = map[string]int{"udp": 33434, "tcp": 80}[proto]
+	}
+	switch {
+	case port < 0 || port > 65535:
+		err = NewError(ClassConfig, "invalid port %d", port)
+	case proto == "udp" && port+maxHops*queries-1 > 65535: // Every UDP probe uses the next port
+		err = NewError(ClassConfig, "port %d leaves no room for %d probes, it must be at most %d", port, maxHops*queries, 65536-maxHops*queries)
+	}
+	if err != nil {
+		result.Fail(err)
+		return result
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", target)
+	if err != nil {
+		result.Fail(err)
+		return result
+	}
+	policyPort := -1
+	if proto == "tcp" {
+		policyPort = port
+	}
+	if err := TargetPolicy.Check(target, ips[0], policyPort); err != nil {
+		result.Fail(err)
+		return result
+	}
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		result.Fail(err)
+		return result
+	}
+	defer conn.Close()
+	t := &tracer{
+		dst:     ips[0],
+		proto:   proto,
+		id:      rand.Intn(0xffff),
+		probes:  map[int]*traceProbe{},
+		sent:    map[int]int{},
+		replies: map[int][]traceReply{},
+	}
+	var udp net.PacketConn
+	if proto == "udp" {
+		if udp, err = net.ListenPacket("udp4", "0.0.0.0:0"); err != nil {
+			result.Fail(err)
+			return result
+		}
+		defer udp.Close()
+		t.id = udp.LocalAddr().(*net.UDPAddr).Port
+	}
+	go t.read(conn)
+	if err := t.run(conn, udp, port, maxHops, queries, timeout); err != nil {
+		result.Fail(err)
+		return result
+	}
+	hops := t.hops(maxHops)
+	if rdns, set := paramBool(args.Task.Params, "rdns"); rdns || !set {
+		lookupHosts(hops)
+	}
+	path := []string{}
+	for _, h := range hops {
+		if len(h.Addr) > 0 {
+			path = append(path, h.Addr)
+		}
+	}
+	previous := lastPath(args.Task.Last)
+	changed := len(previous) > 0 && strings.Join(previous, " ") != strings.Join(path, " ")
+	problems := []string{}
+	if changed {
+		problems = append(problems, fmt.Sprintf("path changed from %s to %s", strings.Join(previous, " > "), strings.Join(path, " > ")))
+	}
+	if t.reached == 0 {
+		problems = append(problems, fmt.Sprintf("%s was not reached within %d hops", ips[0], maxHops))
+	}
+	threshold, _ := paramFloat(args.Task.Params, "loss")
+	if _, set := args.Task.Params["loss"]; !set {
+		threshold = 50
+	}
+	for _, h := range hops {
+		if h.Recv > 0 && h.Loss >= threshold {
+			problems = append(problems, fmt.Sprintf("hop %d (%s) has %.0f%% packet loss", h.TTL, h.Addr, h.Loss))
+		}
+	}
+	result.Warn = len(problems) > 0
+	if result.Warn {
+		result.Notification = fmt.Sprintf("traceroute to %s: %s!", target, strings.Join(problems, ", "))
+	}
+	last := hops[len(hops)-1]
+	result.Spark = &Spark{
+		last.Avg,
+		result.Warn,
+	}
+	result.Update = struct {
+		Target   string `json:"target"`
+		Addr     string `json:"addr"`
+		Protocol string `json:"protocol"`
+		Reached  bool   `json:"reached"`
+		Changed  bool   `json:"changed,omitempty"`
+		Hops     []hop  `json:"hops"`
+	}{
+		Target:   target,
+		Addr:     ips[0].String(),
+		Protocol: proto,
+		Reached:  t.reached > 0,
+		Changed:  changed,
+		Hops:     hops,
+	}
+	return result
+}
+
+// run sends a round of probes for every TTL per query, TTLs past the target are skipped
+// once it has been reached. UDP probes are sent from udp, the others from conn or TCP dials
+func (t *tracer) run(conn *icmp.PacketConn, udp net.PacketConn, port int, maxHops int, queries int, timeout time.Duration) error {
+	seq := rand.Intn(0x7fff)
+	n := 0
+	for q := 0; q < queries; q++ {
+		limit := maxHops
+		if r := t.reachedTTL(); r > 0 {
+			limit = r
+		}
+		var wg sync.WaitGroup
+		for ttl := 1; ttl <= limit; ttl++ {
+			n++
+			switch t.proto {
+			case "icmp":
+				key := (seq + n) & 0xffff
+				msg, _ := (&icmp.Message{
+					Type: ipv4.ICMPTypeEcho,
+					Body: &icmp.Echo{ID: t.id, Seq: key, Data: []byte(Project)},
+				}).Marshal(nil)
+				if err := conn.IPv4PacketConn().SetTTL(ttl); err != nil {
+					return err
+				}
+				t.add(key, ttl)
+				if _, err := conn.WriteTo(msg, &net.IPAddr{IP: t.dst}); err != nil {
+					return err
+				}
+			case "udp":
+				key := port + n - 1
+				if err := ipv4.NewPacketConn(udp).SetTTL(ttl); err != nil {
+					return err
+				}
+				t.add(key, ttl)
+				if _, err := udp.WriteTo([]byte(Project), &net.UDPAddr{IP: t.dst, Port: key}); err != nil {
+					return err
+				}
+			case "tcp":
+				wg.Add(1)
+				go func(ttl int) {
+					defer wg.Done()
+					key := 0 // The local port picked by the kernel, replies quote it
+					d := net.Dialer{
+						Timeout: timeout,
+						Control: setTTL(ttl, func(local int) {
+							key = local
+							t.add(key, ttl)
+						}),
+					}
+					c, err := d.Dial("tcp4", net.JoinHostPort(t.dst.String(), strconv.Itoa(port)))
+					if err == nil {
+						c.Close()
+					}
+					if key > 0 && (err == nil || errors.Is(err, syscall.ECONNREFUSED)) {
+						t.match(key, t.dst, time.Now())
+					}
+				}(ttl)
+			}
+		}
+		time.Sleep(timeout)
+		wg.Wait()
+	}
+	return nil
+}
+
+// read handles ICMP replies until the connection is closed
+func (t *tracer) read(conn *icmp.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		at := time.Now()
+		msg, err := icmp.ParseMessage(1, buf[:n]) // 1 is the ICMP protocol number
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(strings.Split(peer.String(), "%")[0])
+		if ip == nil {
+			continue
+		}
+		var data []byte
+		switch body := msg.Body.(type) {
+		case *icmp.Echo:
+			if msg.Type == ipv4.ICMPTypeEchoReply && t.proto == "icmp" && body.ID == t.id {
+				t.match(body.Seq, ip, at)
+			}
+			continue
+		case *icmp.TimeExceeded:
+			data = body.Data
+		case *icmp.DstUnreach:
+			data = body.Data
+		default:
+			continue
+		}
+		if key, ok := t.key(data); ok {
+			t.match(key, ip, at)
+		}
+	}
+}
+
+// key finds the probe a TimeExceeded or DstUnreach message is about from the IPv4 header
+// and first bytes of the original packet it carries
+func (t *tracer) key(data []byte) (int, bool) {
+	if len(data) < 20 {
+		return 0, false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if len(data) < ihl+8 || !net.IP(data[16:20]).Equal(t.dst) {
+		return 0, false
+	}
+	orig := data[ihl:]
+	switch {
+	case data[9] == 1 && t.proto == "icmp": // ICMP echo: type, code, checksum, ID, seq
+		if int(orig[4])<<8|int(orig[5]) == t.id {
+			return int(orig[6])<<8 | int(orig[7]), true
+		}
+	case data[9] == 17 && t.proto == "udp": // UDP: source port, destination port
+		if int(orig[0])<<8|int(orig[1]) == t.id {
+			return int(orig[2])<<8 | int(orig[3]), true
+		}
+	case data[9] == 6 && t.proto == "tcp": // TCP: source port
+		return int(orig[0])<<8 | int(orig[1]), true
+	}
+	return 0, false
+}
+
+// add registers a probe before it is sent
+func (t *tracer) add(key int, ttl int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.probes[key] = &traceProbe{ttl: ttl, sent: time.Now()}
+	t.sent[ttl]++
+}
+
+// match records the reply to a probe, later replies to the same probe are ignored
+func (t *tracer) match(key int, from net.IP, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.probes[key]
+	if !ok {
+		return
+	}
+	delete(t.probes, key)
+	t.replies[p.ttl] = append(t.replies[p.ttl], traceReply{from.String(), at.Sub(p.sent)})
+	if from.Equal(t.dst) && (t.reached == 0 || p.ttl < t.reached) {
+		t.reached = p.ttl
+	}
+}
+
+// reachedTTL returns the lowest TTL that reached the target so far
+func (t *tracer) reachedTTL() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reached
+}
+
+// hops summarizes the replies of every TTL up to the target, the most common address is
+// used for hops with several routers
+func (t *tracer) hops(maxHops int) []hop {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	limit := maxHops
+	if t.reached > 0 {
+		limit = t.reached
+	}
+	hops := make([]hop, 0, limit)
+	for ttl := 1; ttl <= limit; ttl++ {
+		h := hop{TTL: ttl, Sent: t.sent[ttl]}
+		replies := t.replies[ttl]
+		if len(replies) > h.Sent {
+			replies = replies[:h.Sent]
+		}
+		h.Recv = len(replies)
+		if h.Sent > 0 {
+			h.Loss = float64(h.Sent-h.Recv) / float64(h.Sent) * 100
+		}
+		counts := map[string]int{}
+		var sum time.Duration
+		rtts := make([]time.Duration, 0, len(replies))
+		for _, r := range replies {
+			counts[r.addr]++
+			if counts[r.addr] > counts[h.Addr] {
+				h.Addr = r.addr
+			}
+			sum += r.rtt
+			rtts = append(rtts, r.rtt)
+		}
+		if len(rtts) > 0 {
+			sort.Slice(rtts, func(i, j int) bool {
+				return rtts[i] < rtts[j]
+			})
+			h.Avg = millis64(sum / time.Duration(len(rtts)))
+			h.Min = millis64(rtts[0])
+			h.Max = millis64(rtts[len(rtts)-1])
+		}
+		hops = append(hops, h)
+	}
+	return hops
+}
+
+// lookupHosts adds the reverse DNS name of every hop
+func lookupHosts(hops []hop) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := range hops {
+		if len(hops[i].Addr) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(h *hop) {
+			defer wg.Done()
+			if names, err := net.DefaultResolver.LookupAddr(ctx, h.Addr); err == nil && len(names) > 0 {
+				h.Host = strings.TrimSuffix(names[0], ".")
+			}
+		}(&hops[i])
+	}
+	wg.Wait()
+}
+
+// lastPath returns the addresses of the responding hops of the previous run
+func lastPath(last interface{}) []string {
+	path := []string{}
+	for _, addr := range lastUpdate(last, "hops.#.addr").Array() {
+		if len(addr.String()) > 0 {
+			path = append(path, addr.String())
+		}
+	}
+	return path
+}
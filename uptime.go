@@ -0,0 +1,198 @@
+package tasks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Availability is the uptime report of a task over a window, durations are in milliseconds
+type Availability struct {
+	ID        string  `json:"id"`
+	Window    string  `json:"window"`
+	From      int64   `json:"from"`
+	To        int64   `json:"to"`
+	Uptime    float64 `json:"uptime"`
+	Downtime  int64   `json:"downtime"`
+	Incidents int     `json:"incidents"`
+	MTTR      int64   `json:"mttr"`
+	MTBF      int64   `json:"mtbf"`
+	Target    float64 `json:"target"`
+	Budget    float64 `json:"budget"`
+	Coverage  float64 `json:"coverage"`          // Percent of the window with stored points
+	Partial   bool    `json:"partial,omitempty"` // The history does not cover the window
+	Summary   string  `json:"summary"`
+}
+
+// uptimeUpdate adds an "uptime" field to the JSON of a result update
+type uptimeUpdate struct {
+	update interface{}
+	uptime Availability
+}
+
+// MarshalJSON merges the availability into the update, updates that are not JSON objects
+// are kept under "value"
+func (u uptimeUpdate) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(u.update)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &fields); err != nil || fields == nil {
+		fields = map[string]json.RawMessage{}
+		if u.update != nil {
+			fields["value"] = b
+		}
+	}
+	if fields["uptime"], err = json.Marshal(u.uptime); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// ParseWindow converts a window such as "24h", "7d", "30d", "month" (this calendar
+// month), "lastmonth" or "2021-08" into a time range ending no later than now
+func ParseWindow(window string, now time.Time) (time.Time, time.Time, error) {
+	switch window {
+	case "month":
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()), now, nil
+	case "lastmonth":
+		start := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, now.Location())
+		return start, start.AddDate(0, 1, 0), nil
+	}
+	if m, err := time.ParseInLocation("2006-01", window, now.Location()); err == nil {
+		end := m.AddDate(0, 1, 0)
+		if end.After(now) {
+			end = now
+		}
+		return m, end, nil
+	}
+	if strings.HasSuffix(window, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(window, "d")); err == nil && days > 0 {
+			return now.AddDate(0, 0, -days), now, nil
+		}
+	}
+	if d, err := time.ParseDuration(window); err == nil && d > 0 {
+		return now.Add(-d), now, nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid window %q", window)
+}
+
+// down reports if a point counts against availability
+func (p Point) down() bool {
+	return p.Warn || len(p.Error) > 0
+}
+
+// Uptime calculates availability from points sorted oldest first, each point's state
+// lasts until the next point, time before the first point is not counted. Coverage is the
+// share of the window the points span, less than 99% marks the report as partial
+func Uptime(points []Point, from time.Time, to time.Time, target float64) Availability {
+	a := Availability{
+		From:   millis(from),
+		To:     millis(to),
+		Target: target,
+		Uptime: 100,
+		Budget: 100,
+	}
+	var up, down int64
+	wasDown := false
+	for i, p := range points {
+		if p.Date > a.To {
+			break
+		}
+		end := a.To
+		if i+1 < len(points) && points[i+1].Date < end {
+			end = points[i+1].Date
+		}
+		start := p.Date
+		if start < a.From {
+			start = a.From
+		}
+		if end <= start {
+			continue
+		}
+		if p.down() {
+			down += end - start
+			if !wasDown {
+				a.Incidents++
+			}
+		} else {
+			up += end - start
+		}
+		wasDown = p.down()
+	}
+	a.Downtime = down
+	if window := a.To - a.From; window > 0 {
+		a.Coverage = float64(up+down) / float64(window) * 100
+		a.Partial = a.Coverage < 99
+	}
+	if total := up + down; total > 0 {
+		a.Uptime = float64(up) / float64(total) * 100
+		if allowed := (100 - target) / 100 * float64(total); allowed > 0 {
+			a.Budget = (allowed - float64(down)) / allowed * 100
+		} else if down > 0 {
+			a.Budget = 0
+		}
+	}
+	if a.Incidents > 0 {
+		a.MTTR = down / int64(a.Incidents)
+		a.MTBF = up / int64(a.Incidents)
+	}
+	return a
+}
+
+// TaskUptime loads points for a task from the history and calculates its availability
+func TaskUptime(h History, id string, window string, target float64) (Availability, error) {
+	from, to, err := ParseWindow(window, time.Now())
+	if err != nil {
+		return Availability{}, err
+	}
+	points, err := h.Range(id, from, to)
+	if err != nil {
+		return Availability{}, err
+	}
+	a := Uptime(points, from, to, target)
+	a.ID, a.Window = id, window
+	a.Summary = fmt.Sprintf("%.2f%% (%s)", a.Uptime, window)
+	if a.Partial {
+		covered := time.Duration(a.Coverage / 100 * float64(a.To-a.From) * float64(time.Millisecond))
+		a.Summary = fmt.Sprintf("%.2f%% (%s of %s)", a.Uptime, covered.Round(time.Second), window)
+	}
+	return a, nil
+}
+
+// UptimeHandler serves availability reports as JSON, e.g. ?id=web&id=db&window=30d&target=99.9
+func UptimeHandler(h History) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		window := query.Get("window")
+		if len(window) == 0 {
+			window = "30d"
+		}
+		if _, _, err := ParseWindow(window, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		target := 99.9
+		if t := query.Get("target"); len(t) > 0 {
+			var err error
+			if target, err = strconv.ParseFloat(t, 64); err != nil || target <= 0 || target > 100 {
+				http.Error(w, "invalid target", http.StatusBadRequest)
+				return
+			}
+		}
+		reports := []Availability{}
+		for _, id := range query["id"] {
+			a, err := TaskUptime(h, id, window, target)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			reports = append(reports, a)
+		}
+		writeJSON(w, reports)
+	})
+}
@@ -0,0 +1,143 @@
+package tasks
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"pkg.goda.sh/utils"
+)
+
+// WebSocket performs a WebSocket handshake with optional "headers" and "subprotocols". A
+// "send" message is written once connected and replies are read until one matches the
+// "expect" regex or the "query" JSON path, which must equal "value" when it is set
+func WebSocket(args *TaskArgs) Result {
+	result := NewResult(args.Task)
+	params := utils.ParamsParser(args.Task.Params, utils.DefaultParams{
+		"timeout": "10s",
+	})
+	target := params.Get("url").String()
+	send := params.Get("send").String()
+	query := params.Get("query").String()
+	value, hasValue := args.Task.Params["value"]
+	timeout, err := time.ParseDuration(params.Get("timeout").String())
+	if err != nil || timeout <= 0 {
+		result.Fail(NewError(ClassConfig, "invalid timeout %q", params.Get("timeout").String()))
+		return result
+	}
+	if !strings.HasPrefix(target, "ws://") && !strings.HasPrefix(target, "wss://") {
+		result.Fail(NewError(ClassConfig, "url %q must start with ws:// or wss://", target))
+		return result
+	}
+	var matcher *regexp.Regexp
+	if expect := params.Get("expect").String(); len(expect) > 0 {
+		if matcher, err = regexp.Compile(expect); err != nil {
+			result.Fail(NewError(ClassConfig, "invalid expect regex: %s", err))
+			return result
+		}
+	}
+	header := http.Header{}
+	header.Set("User-Agent", fmt.Sprintf("%s/%s", Project, Version))
+	if m, ok := args.Task.Params["headers"].(map[string]interface{}); ok {
+		for k, v := range m {
+			header.Set(k, fmt.Sprint(v))
+		}
+	}
+	insecure, _ := paramBool(args.Task.Params, "insecure")
+	dialer := &websocket.Dialer{
+		NetDialContext:   TargetPolicy.DialContext,
+		HandshakeTimeout: timeout,
+		Subprotocols:     paramList(args.Task.Params["subprotocols"]),
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: insecure},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	conn, resp, err := dialer.DialContext(ctx, target, header)
+	handshake := time.Since(start)
+	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			err = StatusError(resp.StatusCode) // The server refused the upgrade
+		}
+		result.Fail(err)
+		result.Warn = true
+		return result
+	}
+	defer conn.Close()
+	if len(dialer.Subprotocols) > 0 && len(conn.Subprotocol()) == 0 {
+		result.Fail(NewError(ClassProtocol, "server accepted none of the subprotocols %s", strings.Join(dialer.Subprotocols, ", ")))
+		result.Warn = true
+		return result
+	}
+	var rtt time.Duration
+	reply := ""
+	if len(send) > 0 || matcher != nil || len(query) > 0 {
+		conn.SetReadDeadline(start.Add(timeout))
+		conn.SetWriteDeadline(start.Add(timeout))
+		sent := time.Now()
+		if len(send) > 0 {
+			err = conn.WriteMessage(websocket.TextMessage, []byte(send))
+		}
+		for err == nil {
+			var message []byte
+			if _, message, err = conn.ReadMessage(); err != nil {
+				break
+			}
+			rtt = time.Since(sent)
+			reply = string(message)
+			if wsMatch(reply, matcher, query, value, hasValue) {
+				break
+			}
+		}
+		if err != nil {
+			if ClassifyError(err).Class == ClassTimeout && len(reply) > 0 {
+				err = NewError(ClassParse, "no reply from %s matched within %s", target, timeout)
+			}
+			result.Fail(err)
+			result.Warn = true
+			return result
+		}
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	}
+	result.Spark = &Spark{
+		millis64(handshake + rtt),
+		false,
+	}
+	result.Update = struct {
+		Subprotocol string  `json:"subprotocol,omitempty"`
+		Reply       string  `json:"reply,omitempty"`
+		Handshake   float64 `json:"handshake"`
+		RTT         float64 `json:"rtt,omitempty"`
+	}{
+		Subprotocol: conn.Subprotocol(),
+		Reply:       bannerLine([]byte(reply)),
+		Handshake:   millis64(handshake),
+		RTT:         millis64(rtt),
+	}
+	return result
+}
+
+// wsMatch reports if a reply matches the regex and the JSON query, a query without an
+// expected value only has to exist
+func wsMatch(reply string, matcher *regexp.Regexp, query string, value interface{}, hasValue bool) bool {
+	if matcher != nil && !matcher.MatchString(reply) {
+		return false
+	}
+	if len(query) == 0 {
+		return true
+	}
+	if !gjson.Valid(reply) {
+		return false
+	}
+	v := gjson.Get(reply, query)
+	if !hasValue {
+		return v.Exists()
+	}
+	return v.Exists() && v.String() == fmt.Sprint(value)
+}